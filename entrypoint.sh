@@ -26,7 +26,7 @@ ln -sf /usr/share/zoneinfo/${TIME_ZONE} /etc/localtime
 mkdir /lib64 
 ln -s /lib/libc.musl-x86_64.so.1 /lib64/ld-linux-x86-64.so.2
 
-mkdir -p /var/log/kingfisher
+mkdir -p /var/log/kingfisher/terminal
 
 # grpc
 /usr/local/bin/king-k8s-grpc -dbURL=$DB_URL -listen=$LISTEN:$PORT -listen=$LISTEN:$RPCPORT &
@@ -0,0 +1,54 @@
+package impl
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"net/http"
+)
+
+func ApplyManifest(c *gin.Context) {
+	responseData := HandleApply(resource.Apply, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func HandleApply(action common.ActionType, c *gin.Context) (responseData *common.ResponseData) {
+	// 获取clientSet，如果失败直接返回错误
+	clientSet, err := access.Access(c.Query("cluster"))
+	if err != nil && err.Error() == common.ClusterNotExistError {
+		err = errors.New("cluster does not exist")
+	}
+	responseData = handle.HandlerResponse(nil, err)
+	if responseData.Code != http.StatusOK {
+		log.Errorf("%s%s", common.K8SClientSetError, err)
+		return
+	}
+	dynamicClient, err := access.DynamicClient(c.Query("cluster"))
+	if err != nil {
+		return handle.HandlerResponse(nil, err)
+	}
+	// 获取HTTP的参数，存到handle.Resources结构体中
+	commonParams := handle.GenerateCommonParams(c, clientSet)
+	r := resource.ApplyResource{
+		Params:  commonParams,
+		Dynamic: dynamicClient,
+		Force:   c.Query("force") == "true",
+		DryRun:  c.Query("dryRun") == "true",
+		Admin:   resource.CheckPlatformAdmin(commonParams.User) == nil,
+	}
+	switch action {
+	case resource.Apply:
+		// 和创建接口相同，YAML放在context中
+		postData := common.PostType{}
+		if err := c.BindJSON(&postData); err != nil {
+			return handle.HandlerResponse(nil, err)
+		}
+		response, err := r.Apply(postData.Context)
+		responseData = handle.HandlerResponse(response, err)
+	}
+	return
+}
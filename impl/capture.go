@@ -0,0 +1,49 @@
+package impl
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"net/http"
+	"time"
+)
+
+// 在Pod的网络命名空间中抓包，返回pcap文件
+func CapturePod(c *gin.Context) {
+	r, responseData := podFileResource(c)
+	if responseData.Code != http.StatusOK {
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	if responseData := checkNamespaceAccess(r.Params); responseData != nil {
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	options := &resource.CaptureOptions{}
+	if err := c.ShouldBindJSON(options); err != nil {
+		responseData = handle.HandlerResponse(nil, err)
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	image := c.Query("image")
+	if image == "" {
+		image = DefaultDebugImage
+	}
+	fileName := fmt.Sprintf("%s-%s.pcap", r.Params.Name, time.Now().Format("20060102150405"))
+	w := &attachmentWriter{c: c, contentType: "application/vnd.tcpdump.pcap", fileName: fileName}
+	if err := r.Capture(options, image, w); err != nil {
+		log.Errorf("Pod capture error:%s; Name:%s", err, r.Params.Name)
+		// 还未输出内容时返回错误信息
+		if !w.written {
+			responseData = handle.HandlerResponse(nil, err)
+			c.JSON(responseData.Code, responseData)
+		}
+		return
+	}
+	// 没有抓到任何数据包时tcpdump仍然会输出pcap文件头，这里只处理异常情况
+	if !w.written {
+		c.JSON(http.StatusOK, handle.HandlerResponse(nil, nil))
+	}
+}
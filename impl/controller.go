@@ -9,6 +9,7 @@ import (
 	"github.com/open-kingfisher/king-utils/common/handle"
 	"github.com/open-kingfisher/king-utils/common/log"
 	"net/http"
+	"strconv"
 )
 
 func GetController(c *gin.Context) {
@@ -46,6 +47,11 @@ func ScaleController(c *gin.Context) {
 	c.JSON(http.StatusOK, responseData)
 }
 
+func RevertScaleController(c *gin.Context) {
+	responseData := HandleController(resource.ScaleRevert, c)
+	c.JSON(http.StatusOK, responseData)
+}
+
 func UpdatePatchStepResumeController(c *gin.Context) {
 	responseData := HandleController(common.PatchStepResume, c)
 	c.JSON(http.StatusOK, responseData)
@@ -101,6 +107,53 @@ func RestartController(c *gin.Context) {
 	c.JSON(http.StatusOK, responseData)
 }
 
+// 版本历史
+func ListControllerHistory(c *gin.Context) {
+	responseData := HandleController(resource.ControllerHistory, c)
+	c.JSON(http.StatusOK, responseData)
+}
+
+// 比较两个版本的Pod模板
+func DiffControllerHistory(c *gin.Context) {
+	responseData := HandleController(resource.ControllerHistoryDiff, c)
+	c.JSON(http.StatusOK, responseData)
+}
+
+// 回滚到指定版本
+func RollbackController(c *gin.Context) {
+	responseData := HandleController(resource.ControllerRollback, c)
+	c.JSON(http.StatusOK, responseData)
+}
+
+// 分步上线记录
+func ListControllerRollout(c *gin.Context) {
+	responseData := HandleController(resource.RolloutList, c)
+	c.JSON(http.StatusOK, responseData)
+}
+
+func GetControllerRollout(c *gin.Context) {
+	responseData := HandleController(resource.RolloutGet, c)
+	c.JSON(http.StatusOK, responseData)
+}
+
+// 终止分步上线并回滚到上线前的版本
+func AbortControllerRollout(c *gin.Context) {
+	responseData := HandleController(resource.RolloutAbort, c)
+	c.JSON(http.StatusOK, responseData)
+}
+
+// 金丝雀发布
+func CanaryController(c *gin.Context) {
+	responseData := HandleController(resource.CanaryStart, c)
+	c.JSON(http.StatusOK, responseData)
+}
+
+// 蓝绿发布
+func BlueGreenController(c *gin.Context) {
+	responseData := HandleController(resource.BlueGreenStart, c)
+	c.JSON(http.StatusOK, responseData)
+}
+
 func HandleController(action common.ActionType, c *gin.Context) (responseData *common.ResponseData) {
 	// 获取clientSet，如果失败直接返回错误
 	clientSet, err := access.Access(c.Query("cluster"))
@@ -147,13 +200,15 @@ func HandleController(action common.ActionType, c *gin.Context) (responseData *c
 			responseData = handle.HandlerResponse(nil, err)
 		}
 	case common.Scale:
-		if err := c.BindJSON(&r.Params.PatchData); err == nil {
-			response, err := r.Scale()
-			responseData = handle.HandlerResponse(response, err)
-		} else {
-			responseData = handle.HandlerResponse(nil, err)
-		}
+		r.Force = c.Query("force") == "true"
+		response, err := r.Scale()
+		responseData = handle.HandlerResponse(response, err)
+	case resource.ScaleRevert:
+		r.Force = c.Query("force") == "true"
+		response, err := r.RevertScale()
+		responseData = handle.HandlerResponse(response, err)
 	case common.PatchImage:
+		r.NodeGroup = c.Query("nodeGroup")
 		if err := c.BindJSON(&r.Params.PatchData); err == nil {
 			response, err := r.PatchImage()
 			responseData = handle.HandlerResponse(response, err)
@@ -202,6 +257,7 @@ func HandleController(action common.ActionType, c *gin.Context) (responseData *c
 			responseData = handle.HandlerResponse(nil, errors.New("controller kind doesn't exist"))
 		}
 	case common.SaveAsTemplate:
+		r.DefaultTemplate = c.Query("default") == "true"
 		if err := c.BindJSON(&r.TemplateData); err == nil {
 			err := r.SaveAsTemplate()
 			responseData = handle.HandlerResponse(nil, err)
@@ -215,6 +271,50 @@ func HandleController(action common.ActionType, c *gin.Context) (responseData *c
 		} else {
 			responseData = handle.HandlerResponse(nil, err)
 		}
+	case resource.ControllerHistory:
+		response, err := r.History()
+		responseData = handle.HandlerResponse(response, err)
+	case resource.ControllerHistoryDiff:
+		from, err := strconv.ParseInt(c.Query("from"), 10, 64)
+		if err != nil {
+			responseData = handle.HandlerResponse(nil, errors.New("invalid from revision"))
+			return
+		}
+		// to为空时和当前版本比较
+		to, _ := strconv.ParseInt(c.Query("to"), 10, 64)
+		response, err := r.HistoryDiff(from, to)
+		responseData = handle.HandlerResponse(response, err)
+	case resource.ControllerRollback:
+		// revision为空时回滚到上一个版本
+		revision, _ := strconv.ParseInt(c.Query("revision"), 10, 64)
+		response, err := r.Rollback(revision)
+		responseData = handle.HandlerResponse(response, err)
+	case resource.RolloutList:
+		response, err := r.ListRollout()
+		responseData = handle.HandlerResponse(response, err)
+	case resource.RolloutGet:
+		response, err := r.GetRollout(c.Param("id"))
+		responseData = handle.HandlerResponse(response, err)
+	case resource.CanaryStart:
+		postData := &resource.CanaryPostData{}
+		if err := c.BindJSON(postData); err == nil {
+			response, err := r.StartCanary(postData)
+			responseData = handle.HandlerResponse(response, err)
+		} else {
+			responseData = handle.HandlerResponse(nil, err)
+		}
+	case resource.BlueGreenStart:
+		postData := &resource.BlueGreenPostData{}
+		if err := c.BindJSON(postData); err == nil {
+			response, err := r.StartBlueGreen(postData)
+			responseData = handle.HandlerResponse(response, err)
+		} else {
+			responseData = handle.HandlerResponse(nil, err)
+		}
+	case resource.RolloutAbort:
+		r.Params.PatchData = &common.PatchJson{}
+		response, err := r.AbortRollout()
+		responseData = handle.HandlerResponse(response, err)
 	case common.GetNamespaceIsExistLabel:
 		response, err := r.GetNamespaceIsExistLabel()
 		responseData = handle.HandlerResponse(response, err)
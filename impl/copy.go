@@ -0,0 +1,116 @@
+package impl
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"net/http"
+	"path"
+)
+
+// 下载容器中的文件或者目录，输出为tar流
+func DownloadPodFile(c *gin.Context) {
+	r, responseData := podFileResource(c)
+	if responseData.Code != http.StatusOK {
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	if responseData := checkNamespaceAccess(r.Params); responseData != nil {
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	w := &attachmentWriter{c: c, contentType: "application/x-tar", fileName: path.Base(path.Clean("/"+r.FilePath)) + ".tar"}
+	if err := r.CopyFrom(w); err != nil {
+		log.Errorf("Pod download file error:%s; Path:%s; Name:%s", err, r.FilePath, r.Params.Name)
+		// 还未输出内容时返回错误信息，否则断开连接，避免客户端把不完整的tar当作成功的下载
+		if !w.written {
+			responseData = handle.HandlerResponse(nil, err)
+			c.JSON(responseData.Code, responseData)
+		} else {
+			w.abort()
+		}
+	}
+}
+
+// 上传文件到容器的指定目录
+func UploadPodFile(c *gin.Context) {
+	r, responseData := podFileResource(c)
+	if responseData.Code != http.StatusOK {
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	if responseData := checkNamespaceAccess(r.Params); responseData != nil {
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, resource.CopyToLimit+1024*1024)
+	file, err := c.FormFile("file")
+	if err != nil {
+		responseData = handle.HandlerResponse(nil, err)
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	src, err := file.Open()
+	if err != nil {
+		responseData = handle.HandlerResponse(nil, err)
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	defer src.Close()
+	err = r.CopyTo(file.Filename, file.Size, src)
+	responseData = handle.HandlerResponse(nil, err)
+	c.JSON(responseData.Code, responseData)
+}
+
+func podFileResource(c *gin.Context) (*resource.PodResource, *common.ResponseData) {
+	// 获取clientSet，如果失败直接返回错误
+	clientSet, err := access.Access(c.Query("cluster"))
+	if err != nil && err.Error() == common.ClusterNotExistError {
+		err = errors.New("cluster does not exist")
+	}
+	responseData := handle.HandlerResponse(nil, err)
+	if responseData.Code != http.StatusOK {
+		log.Errorf("%s%s", common.K8SClientSetError, err)
+		return nil, responseData
+	}
+	// 获取HTTP的参数，存到handle.Resources结构体中
+	commonParams := handle.GenerateCommonParams(c, clientSet)
+	r := &resource.PodResource{
+		Params:    commonParams,
+		Container: c.Query("container"),
+		FilePath:  c.Query("path"),
+	}
+	return r, responseData
+}
+
+// 第一次写入时才设置下载的响应头，命令执行失败时还可以返回JSON错误信息
+type attachmentWriter struct {
+	c           *gin.Context
+	contentType string
+	fileName    string
+	written     bool
+}
+
+func (w *attachmentWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.written = true
+		w.c.Header("Content-Type", w.contentType)
+		w.c.Header("Content-Disposition", "attachment; filename="+w.fileName)
+		w.c.Status(http.StatusOK)
+	}
+	return w.c.Writer.Write(p)
+}
+
+// 已经开始输出后无法再返回错误，直接关闭连接，分块传输没有结束标记，客户端会认为下载失败
+func (w *attachmentWriter) abort() {
+	conn, _, err := w.c.Writer.Hijack()
+	if err != nil {
+		log.Errorf("Hijack connection error:%s", err)
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,70 @@
+package impl
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"net/http"
+	"strconv"
+)
+
+// 列出调试、救援以及节点终端Pod
+func ListDebugSession(c *gin.Context) {
+	responseData := HandleDebugSession(common.List, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+// 延长调试会话的存活时间
+func ExtendDebugSession(c *gin.Context) {
+	responseData := HandleDebugSession(resource.DebugSessionExtend, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func DeleteDebugSession(c *gin.Context) {
+	responseData := HandleDebugSession(common.Delete, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func HandleDebugSession(action common.ActionType, c *gin.Context) (responseData *common.ResponseData) {
+	// 获取clientSet，如果失败直接返回错误
+	clientSet, err := access.Access(c.Query("cluster"))
+	if err != nil && err.Error() == common.ClusterNotExistError {
+		err = errors.New("cluster does not exist")
+	}
+	responseData = handle.HandlerResponse(nil, err)
+	if responseData.Code != http.StatusOK {
+		log.Errorf("%s%s", common.K8SClientSetError, err)
+		return
+	}
+	// 获取HTTP的参数，存到handle.Resources结构体中
+	commonParams := handle.GenerateCommonParams(c, clientSet)
+	ttl, _ := strconv.ParseInt(c.Query("ttl"), 10, 64)
+	r := resource.DebugSessionResource{
+		Params: commonParams,
+		Admin:  resource.CheckPlatformAdmin(commonParams.User) == nil,
+		TTL:    ttl,
+	}
+	// 非管理员只能管理有权限的命名空间中的会话
+	if !r.Admin {
+		if err := resource.CheckNamespaceAccess(r.Params.User, r.Params.Product, r.Params.Cluster, r.Params.Namespace); err != nil {
+			return &common.ResponseData{Code: http.StatusForbidden, Msg: err.Error(), Data: ""}
+		}
+	}
+	// 调用结构体方法
+	switch action {
+	case common.List:
+		response, err := r.List()
+		responseData = handle.HandlerResponse(response, err)
+	case resource.DebugSessionExtend:
+		response, err := r.Extend()
+		responseData = handle.HandlerResponse(response, err)
+	case common.Delete:
+		err := r.Delete()
+		responseData = handle.HandlerResponse(nil, err)
+	}
+	return
+}
@@ -0,0 +1,181 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"golang.org/x/net/websocket"
+	"k8s.io/api/core/v1"
+	"net/http"
+	"strconv"
+)
+
+// 通过WebSocket实时输出Pod日志
+func PodLog(ws *websocket.Conn) {
+	defer func() {
+		ws.Close()
+		if err := recover(); err != nil {
+			log.Errorf("Pod log panic: %s", err)
+		}
+	}()
+
+	c := ws.Request()
+	ws.PayloadType = websocket.BinaryFrame
+	cluster := c.FormValue("cluster")
+	clientSet, err := access.Access(cluster)
+	if err != nil {
+		log.Errorf("Client set error: %v", err)
+		websocket.Message.Send(ws, err.Error())
+		return
+	}
+	r := resource.PodResource{
+		Params: &handle.Resources{
+			Cluster:   cluster,
+			Namespace: c.FormValue("namespace"),
+			Name:      c.FormValue("podName"),
+			ClientSet: clientSet,
+		},
+		Container:      c.FormValue("container"),
+		Follow:         formBool(c, "follow"),
+		Timestamps:     formBool(c, "timestamps"),
+		Previous:       formBool(c, "previous"),
+		InitContainers: formBool(c, "initContainers"),
+		SinceSeconds:   formInt64(c, "sinceSeconds"),
+		TailLines:      formInt64(c, "tailLines"),
+		LimitBytes:     formInt64(c, "limitBytes"),
+	}
+	ctx, cancel := logContext(ws)
+	defer cancel()
+	if err := r.LogStream(ctx, ws); err != nil {
+		websocket.Message.Send(ws, err.Error())
+	}
+}
+
+// 通过WebSocket实时聚合输出Deployment、DaemonSet、StatefulSet下所有Pod的日志
+func ControllerLog(ws *websocket.Conn) {
+	defer func() {
+		ws.Close()
+		if err := recover(); err != nil {
+			log.Errorf("Controller log panic: %s", err)
+		}
+	}()
+
+	c := ws.Request()
+	ws.PayloadType = websocket.BinaryFrame
+	cluster := c.FormValue("cluster")
+	clientSet, err := access.Access(cluster)
+	if err != nil {
+		log.Errorf("Client set error: %v", err)
+		websocket.Message.Send(ws, err.Error())
+		return
+	}
+	r := resource.ControllerResource{
+		Params: &handle.Resources{
+			Cluster:    cluster,
+			Namespace:  c.FormValue("namespace"),
+			Name:       c.FormValue("name"),
+			Controller: c.FormValue("controller"),
+			ClientSet:  clientSet,
+		},
+		LogOptions: &v1.PodLogOptions{
+			Container:    c.FormValue("container"),
+			Follow:       formBool(c, "follow"),
+			Timestamps:   formBool(c, "timestamps"),
+			Previous:     formBool(c, "previous"),
+			SinceSeconds: formInt64(c, "sinceSeconds"),
+			TailLines:    formInt64(c, "tailLines"),
+			LimitBytes:   formInt64(c, "limitBytes"),
+		},
+		LogInitContainers: formBool(c, "initContainers"),
+	}
+	ctx, cancel := logContext(ws)
+	defer cancel()
+	if err := r.LogStream(ctx, ws); err != nil {
+		websocket.Message.Send(ws, err.Error())
+	}
+}
+
+// 客户端断开WebSocket连接后取消日志流的读取
+func logContext(ws *websocket.Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		var msg string
+		for {
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+	return ctx, cancel
+}
+
+func formBool(c *http.Request, key string) bool {
+	v, _ := strconv.ParseBool(c.FormValue(key))
+	return v
+}
+
+// 参数为空或者格式不正确返回nil，使用Kubernetes的默认值
+func formInt64(c *http.Request, key string) *int64 {
+	v, err := strconv.ParseInt(c.FormValue(key), 10, 64)
+	if err != nil || v <= 0 {
+		return nil
+	}
+	return &v
+}
+
+func PodLogBundle(c *gin.Context) {
+	HandleLogBundle(resource.LogBundlePod, c)
+}
+
+func ControllerLogBundle(c *gin.Context) {
+	HandleLogBundle(resource.LogBundleController, c)
+}
+
+func NamespaceLogBundle(c *gin.Context) {
+	HandleLogBundle(resource.LogBundleNamespace, c)
+}
+
+// 下载日志打包文件，出错时返回JSON，成功时直接输出tar.gz文件
+func HandleLogBundle(kind string, c *gin.Context) {
+	// 获取clientSet，如果失败直接返回错误
+	clientSet, err := access.Access(c.Query("cluster"))
+	if err != nil && err.Error() == common.ClusterNotExistError {
+		err = errors.New("cluster does not exist")
+	}
+	responseData := handle.HandlerResponse(nil, err)
+	if responseData.Code != http.StatusOK {
+		log.Errorf("%s%s", common.K8SClientSetError, err)
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	// 获取HTTP的参数，存到handle.Resources结构体中
+	commonParams := handle.GenerateCommonParams(c, clientSet)
+	r := resource.LogBundleResource{
+		Params:       commonParams,
+		Kind:         kind,
+		SinceSeconds: formInt64(c.Request, "sinceSeconds"),
+		TailLines:    formInt64(c.Request, "tailLines"),
+		LimitBytes:   formInt64(c.Request, "limitBytes"),
+	}
+	if responseData := checkNamespaceAccess(r.Params); responseData != nil {
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	pods, err := r.ListPod()
+	if err != nil {
+		responseData = handle.HandlerResponse(nil, err)
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", "attachment; filename="+r.FileName())
+	if err := r.Export(pods, c.Writer); err != nil {
+		log.Errorf("Log bundle export error:%s; Kind:%s; Name:%s", err, kind, r.Params.Name)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/open-kingfisher/king-utils/common/handle"
 	"github.com/open-kingfisher/king-utils/common/log"
 	"net/http"
+	"strconv"
 )
 
 func GetNode(c *gin.Context) {
@@ -51,6 +52,12 @@ func NodeMetric(c *gin.Context) {
 	c.JSON(responseData.Code, responseData)
 }
 
+// 在节点上创建特权Pod，返回的Pod通过终端连接即可进入节点
+func ShellNode(c *gin.Context) {
+	responseData := HandleNode(resource.NodeShell, c)
+	c.JSON(responseData.Code, responseData)
+}
+
 func HandleNode(action common.ActionType, c *gin.Context) (responseData *common.ResponseData) {
 	// 获取clientSet，如果失败直接返回错误
 	clientSet, err := access.Access(c.Query("cluster"))
@@ -109,6 +116,21 @@ func HandleNode(action common.ActionType, c *gin.Context) (responseData *common.
 		} else {
 			responseData = handle.HandlerResponse(response.Items, err)
 		}
+	case resource.NodeShell:
+		// 节点终端默认只允许平台管理员使用，Pod创建在用户有权限的命名空间中
+		if err := resource.CheckNodeShellAccess(r.Params.User); err != nil {
+			return &common.ResponseData{Code: http.StatusForbidden, Msg: err.Error(), Data: ""}
+		}
+		if err := resource.CheckNamespaceAccess(r.Params.User, r.Params.Product, r.Params.Cluster, r.Params.Namespace); err != nil {
+			return &common.ResponseData{Code: http.StatusForbidden, Msg: err.Error(), Data: ""}
+		}
+		image := c.Query("image")
+		if image == "" {
+			image = DefaultDebugImage
+		}
+		ttl, _ := strconv.ParseInt(c.Query("ttl"), 10, 64)
+		response, err := r.Shell(image, ttl)
+		responseData = handle.HandlerResponse(response, err)
 	case common.NodeMetric:
 		response, err := r.NodeMetric()
 		if err != nil {
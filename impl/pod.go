@@ -83,6 +83,19 @@ func OnlinePod(c *gin.Context) {
 	c.JSON(responseData.Code, responseData)
 }
 
+func ExecPod(c *gin.Context) {
+	responseData := HandlePod(resource.PodExec, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+// 执行命令、传输文件等操作直接作用于容器，需要用户有命名空间的权限
+func checkNamespaceAccess(params *handle.Resources) *common.ResponseData {
+	if err := resource.CheckNamespaceAccess(params.User, params.Product, params.Cluster, params.Namespace); err != nil {
+		return &common.ResponseData{Code: http.StatusForbidden, Msg: err.Error(), Data: ""}
+	}
+	return nil
+}
+
 func HandlePod(action common.ActionType, c *gin.Context) (responseData *common.ResponseData) {
 	// 获取clientSet，如果失败直接返回错误
 	clientSet, err := access.Access(c.Query("cluster"))
@@ -158,10 +171,13 @@ func HandlePod(action common.ActionType, c *gin.Context) (responseData *common.R
 		r.Image = image
 		r.DebugImage = debugImage
 		r.EntryPoint = c.Query("entryPoint")
+		r.DebugMode = c.Query("mode")
+		r.TTL, _ = strconv.ParseInt(c.Query("ttl"), 10, 64)
 		response, err := r.Debug()
 		responseData = handle.HandlerResponse(response, err)
 	case common.Rescue:
 		r.Container = c.Query("container")
+		r.TTL, _ = strconv.ParseInt(c.Query("ttl"), 10, 64)
 		//r.EntryPoint = c.Query("entryPoint")
 		condition := r.RescueCondition
 		if err = c.BindJSON(&condition); err == nil {
@@ -189,6 +205,16 @@ func HandlePod(action common.ActionType, c *gin.Context) (responseData *common.R
 		r.Plugin = c.Query("plugin")
 		err := r.UnKubectl()
 		responseData = handle.HandlerResponse(nil, err)
+	case resource.PodExec:
+		if responseData := checkNamespaceAccess(r.Params); responseData != nil {
+			return responseData
+		}
+		if err := c.BindJSON(&r.ExecData); err == nil {
+			response, err := r.Exec()
+			responseData = handle.HandlerResponse(response, err)
+		} else {
+			responseData = handle.HandlerResponse(nil, err)
+		}
 	case common.DebugPodIPByPod:
 		response, err := r.GetDebugPodIPByPod()
 		responseData = handle.HandlerResponse(response, err)
@@ -0,0 +1,50 @@
+package impl
+
+import (
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"golang.org/x/net/websocket"
+)
+
+// 通过WebSocket转发Pod或者Service的端口，每个WebSocket连接对应一个TCP连接
+func PortForward(ws *websocket.Conn) {
+	defer func() {
+		ws.Close()
+		if err := recover(); err != nil {
+			log.Errorf("Port forward panic: %s", err)
+		}
+	}()
+
+	c := ws.Request()
+	ws.PayloadType = websocket.BinaryFrame
+	cluster := c.FormValue("cluster")
+	clientSet, err := access.Access(cluster)
+	if err != nil {
+		log.Errorf("Client set error: %v", err)
+		websocket.Message.Send(ws, err.Error())
+		return
+	}
+	r := resource.PortForwardResource{
+		Params: &handle.Resources{
+			Cluster:   cluster,
+			Namespace: c.FormValue("namespace"),
+			Product:   c.FormValue("productId"),
+			Name:      c.FormValue("podName"),
+			User:      webSocketUser(ws),
+			ClientSet: clientSet,
+		},
+		Service: c.FormValue("service"),
+		Port:    c.FormValue("port"),
+	}
+	pod, port, err := r.Resolve()
+	if err != nil {
+		log.Errorf("Port forward resolve error: %v", err)
+		websocket.Message.Send(ws, err.Error())
+		return
+	}
+	if err := r.Forward(c.Context(), pod, port, ws); err != nil {
+		log.Errorf("Port forward error: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package impl
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"net/http"
+)
+
+func ListScaleSchedule(c *gin.Context) {
+	responseData := HandleScaleSchedule(common.List, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func GetScaleSchedule(c *gin.Context) {
+	responseData := HandleScaleSchedule(common.Get, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func CreateScaleSchedule(c *gin.Context) {
+	responseData := HandleScaleSchedule(common.Create, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func UpdateScaleSchedule(c *gin.Context) {
+	responseData := HandleScaleSchedule(common.Update, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func DeleteScaleSchedule(c *gin.Context) {
+	responseData := HandleScaleSchedule(common.Delete, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func HandleScaleSchedule(action common.ActionType, c *gin.Context) (responseData *common.ResponseData) {
+	// 获取clientSet，如果失败直接返回错误
+	clientSet, err := access.Access(c.Query("cluster"))
+	if err != nil && err.Error() == common.ClusterNotExistError {
+		err = errors.New("cluster does not exist")
+	}
+	responseData = handle.HandlerResponse(nil, err)
+	if responseData.Code != http.StatusOK {
+		log.Errorf("%s%s", common.K8SClientSetError, err)
+		return
+	}
+	// 获取HTTP的参数，存到handle.Resources结构体中
+	commonParams := handle.GenerateCommonParams(c, clientSet)
+	r := resource.ScaleScheduleResource{Params: commonParams}
+	// 调用结构体方法
+	switch action {
+	case common.List:
+		response, err := r.List()
+		responseData = handle.HandlerResponse(response, err)
+	case common.Get:
+		response, err := r.Get()
+		responseData = handle.HandlerResponse(response, err)
+	case common.Create:
+		if err := c.BindJSON(&r.PostData); err == nil {
+			response, err := r.Create()
+			responseData = handle.HandlerResponse(response, err)
+		} else {
+			responseData = handle.HandlerResponse(nil, err)
+		}
+	case common.Update:
+		if err := c.BindJSON(&r.PostData); err == nil {
+			response, err := r.Update()
+			responseData = handle.HandlerResponse(response, err)
+		} else {
+			responseData = handle.HandlerResponse(nil, err)
+		}
+	case common.Delete:
+		err := r.Delete()
+		responseData = handle.HandlerResponse(nil, err)
+	}
+	return
+}
@@ -0,0 +1,101 @@
+package impl
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"net/http"
+	"strconv"
+)
+
+func PreviewTemplateDeploy(c *gin.Context) {
+	responseData := HandleTemplateDeploy(resource.TemplatePreviewAction, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func TemplateDeploy(c *gin.Context) {
+	responseData := HandleTemplateDeploy(common.Create, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func HandleTemplateDeploy(action common.ActionType, c *gin.Context) (responseData *common.ResponseData) {
+	// 获取clientSet，如果失败直接返回错误，模板可以部署到任意集群
+	clientSet, err := access.Access(c.Query("cluster"))
+	if err != nil && err.Error() == common.ClusterNotExistError {
+		err = errors.New("cluster does not exist")
+	}
+	responseData = handle.HandlerResponse(nil, err)
+	if responseData.Code != http.StatusOK {
+		log.Errorf("%s%s", common.K8SClientSetError, err)
+		return
+	}
+	// 获取HTTP的参数，存到handle.Resources结构体中
+	commonParams := handle.GenerateCommonParams(c, clientSet)
+	version, _ := strconv.Atoi(c.Query("version"))
+	r := resource.TemplateDeployResource{Params: commonParams, Version: version}
+	if err := c.BindJSON(&r.PostData); err != nil {
+		return handle.HandlerResponse(nil, err)
+	}
+	// 调用结构体方法
+	switch action {
+	case resource.TemplatePreviewAction:
+		response, err := r.Preview()
+		responseData = handle.HandlerResponse(response, err)
+	case common.Create:
+		response, err := r.Deploy()
+		responseData = handle.HandlerResponse(response, err)
+	}
+	return
+}
+
+func ListTemplateVersion(c *gin.Context) {
+	responseData := HandleTemplateVersion(resource.TemplateVersionList, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func GetTemplateVersion(c *gin.Context) {
+	responseData := HandleTemplateVersion(common.Get, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func DiffTemplateVersion(c *gin.Context) {
+	responseData := HandleTemplateVersion(resource.TemplateVersionDiff, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func SetDefaultTemplateVersion(c *gin.Context) {
+	responseData := HandleTemplateVersion(resource.TemplateVersionDefault, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+// 模板保存在数据库中，不需要访问集群
+func HandleTemplateVersion(action common.ActionType, c *gin.Context) (responseData *common.ResponseData) {
+	commonParams := handle.GenerateCommonParams(c, nil)
+	r := resource.TemplateVersionResource{Params: commonParams}
+	version, _ := strconv.Atoi(c.Param("version"))
+	switch action {
+	case resource.TemplateVersionList:
+		response, err := r.List()
+		responseData = handle.HandlerResponse(response, err)
+	case common.Get:
+		response, err := r.Get(version)
+		responseData = handle.HandlerResponse(response, err)
+	case resource.TemplateVersionDiff:
+		// to为空时和默认版本比较
+		from, err := strconv.Atoi(c.Query("from"))
+		if err != nil {
+			return handle.HandlerResponse(nil, errors.New("invalid from parameter: "+err.Error()))
+		}
+		to, _ := strconv.Atoi(c.Query("to"))
+		response, err := r.Diff(from, to)
+		responseData = handle.HandlerResponse(response, err)
+	case resource.TemplateVersionDefault:
+		response, err := r.SetDefault(version)
+		responseData = handle.HandlerResponse(response, err)
+	}
+	return
+}
@@ -2,52 +2,133 @@ package impl
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/docker/docker/pkg/term"
+	"github.com/open-kingfisher/king-k8s/resource"
 	"github.com/open-kingfisher/king-utils/common"
 	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
 	"github.com/open-kingfisher/king-utils/common/log"
 	"github.com/open-kingfisher/king-utils/db"
 	"github.com/open-kingfisher/king-utils/interrupt"
 	"github.com/open-kingfisher/king-utils/kit"
 	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
 	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+	utilexec "k8s.io/client-go/util/exec"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 type terminalSize struct {
 	conn     *websocket.Conn
 	sizeChan chan *remotecommand.TerminalSize
+	recorder *resource.TerminalRecorder
+	session  *resource.TerminalSession
+	// 一次输入超过读取缓冲区时剩余的数据，下一次读取时返回
+	pending []byte
 }
 
-func (t terminalSize) Read(p []byte) (int, error) {
-	var reply string
-	var msg map[string]uint16
-	if err := websocket.Message.Receive(t.conn, &reply); err != nil {
-		return 0, err
+// 从会话的输入中读取，包括会话所有者以及被批准的读写参与者的输入
+func (t *terminalSize) Read(p []byte) (int, error) {
+	if len(t.pending) > 0 {
+		return t.read(p, t.pending), nil
 	}
-	if err := json.Unmarshal([]byte(reply), &msg); err != nil {
-		return copy(p, reply), nil
-	} else {
-		t.sizeChan <- &remotecommand.TerminalSize{
-			Width:  msg["cols"],
-			Height: msg["rows"],
+	select {
+	case input := <-t.session.Input():
+		if input.Resize {
+			select {
+			case t.sizeChan <- &remotecommand.TerminalSize{Width: input.Width, Height: input.Height}:
+			case <-t.session.Done():
+				return 0, io.EOF
+			}
+			return 0, nil
 		}
-		return 0, nil
+		return t.read(p, input.Data), nil
+	case <-t.session.Done():
+		return 0, io.EOF
+	}
+}
+
+func (t *terminalSize) read(p, data []byte) int {
+	n := copy(p, data)
+	t.pending = data[n:]
+	if t.recorder != nil {
+		t.recorder.Input(p[:n])
 	}
+	return n
 }
 
 func (t *terminalSize) Next() *remotecommand.TerminalSize {
 	size := <-t.sizeChan
 	log.Info("terminal size to width: %s height: %s", size.Width, size.Height)
+	if t.recorder != nil && size != nil {
+		t.recorder.Resize(size.Width, size.Height)
+	}
 	return size
 }
 
+// 终端输出同时写入录像，并同步给共享会话的参与者
+type recordWriter struct {
+	conn     *websocket.Conn
+	recorder *resource.TerminalRecorder
+	session  *resource.TerminalSession
+}
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	if w.recorder != nil {
+		w.recorder.Output(p)
+	}
+	w.session.Broadcast(p)
+	return w.conn.Write(p)
+}
+
+// 读取会话所有者的WebSocket消息，空闲超时或者达到最长时间时终止会话
+func readTerminal(ws *websocket.Conn, session *resource.TerminalSession) {
+	for {
+		var reply string
+		var msg map[string]uint16
+		ws.SetReadDeadline(session.Deadline())
+		if err := websocket.Message.Receive(ws, &reply); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// 参与者的输入同样会延长空闲时间
+				if time.Now().Before(session.Deadline()) {
+					continue
+				}
+				session.Terminate(session.TimeoutReason())
+				return
+			}
+			session.Terminate("")
+			return
+		}
+		if err := json.Unmarshal([]byte(reply), &msg); err != nil {
+			session.Touch()
+			session.Send(resource.TerminalInput{Data: []byte(reply)})
+		} else {
+			session.Send(resource.TerminalInput{Resize: true, Width: msg["cols"], Height: msg["rows"]})
+		}
+	}
+}
+
+const (
+	TerminalOpen  = common.ActionType("terminal_open")
+	TerminalClose = common.ActionType("terminal_close")
+)
+
+// 默认的shell探测顺序，powershell用于Windows节点
+var TerminalShells = []string{"/bin/bash", "/bin/sh", "/bin/ash", "powershell.exe"}
+
 func Terminal(ws *websocket.Conn) {
 	defer func() {
 		ws.Close()
@@ -65,20 +146,168 @@ func Terminal(ws *websocket.Conn) {
 	clientSet, err := access.Access(cluster)
 	if err != nil {
 		log.Errorf("Client set error: %v", err)
+		return
 	}
 	config, err := getConfig(cluster)
 	if err != nil {
 		log.Errorf("Get config error: %v", err)
+		return
 	}
-	if err := Handler(ws, namespace, podName, containerName, "/bin/sh", config, clientSet); err != nil {
-		err := Handler(ws, namespace, podName, containerName, "/bin/bash", config, clientSet)
-		if err != nil {
-			log.Error("Handler /bin/bash: ", err)
+	params := &handle.Resources{
+		Namespace: namespace,
+		Cluster:   cluster,
+		Product:   c.FormValue("productId"),
+		Name:      podName,
+		User:      webSocketUser(ws),
+		ClientSet: clientSet,
+	}
+	var userName string
+	if params.User != nil {
+		userName = params.User.Name
+	}
+	// 节点终端Pod只允许创建者连接，通过nsenter进入节点
+	var prefix []string
+	if pod, err := clientSet.CoreV1().Pods(namespace).Get(podName, metav1.GetOptions{}); err == nil && resource.IsNodeShellPod(pod) {
+		if err := resource.CheckNodeShellOwner(pod, params.User); err != nil {
+			log.Errorf("User %s node shell %s denied: %s", userName, podName, err)
+			ws.Write([]byte(err.Error() + "\r\n"))
+			return
 		}
+		prefix = resource.NodeShellCommand
+	}
+	// 超过用户或者集群的并发会话限制时拒绝连接
+	session, err := resource.NewTerminalSession(&resource.TerminalSession{
+		User:       userName,
+		Cluster:    cluster,
+		Namespace:  namespace,
+		Pod:        podName,
+		Container:  containerName,
+		RemoteAddr: c.RemoteAddr,
+	})
+	if err != nil {
+		log.Errorf("Terminal session error: %v", err)
+		ws.Write([]byte(err.Error() + "\r\n"))
+		return
+	}
+	defer session.Close()
+	// 记录终端会话的打开和关闭
+	start := time.Now()
+	terminalAuditLog(params, TerminalOpen, map[string]interface{}{"container": containerName, "remoteAddr": c.RemoteAddr})
+	defer func() {
+		terminalAuditLog(params, TerminalClose, map[string]interface{}{"container": containerName, "remoteAddr": c.RemoteAddr, "duration": int64(time.Since(start).Seconds())})
+	}()
+	// 录制终端会话，录制失败不影响终端使用
+	recorder, err := resource.NewTerminalRecorder(&resource.TerminalRecord{
+		User:      userName,
+		Cluster:   cluster,
+		Namespace: namespace,
+		Pod:       podName,
+		Container: containerName,
+	})
+	if err != nil {
+		log.Errorf("Terminal recorder error: %v", err)
+	} else {
+		defer recorder.Close()
+	}
+	// 指定shell时只使用指定的shell，否则在会话开始前按顺序探测容器中可用的shell
+	shell := terminalShell(c.FormValue("shell"))
+	if shell == "" {
+		if shell, err = probeShell(namespace, podName, containerName, prefix, config, clientSet); err != nil {
+			log.Errorf("Probe shell in %s/%s error: %s", podName, containerName, err)
+			ws.Write([]byte(err.Error() + "\r\n"))
+			return
+		}
+	}
+	// 节点终端断开连接后删除Pod
+	if prefix != nil {
+		defer resource.DeleteNodeShellPod(params, podName)
+	}
+	go readTerminal(ws, session)
+	cmd := append(append([]string{}, prefix...), shell)
+	err = Handler(ws, namespace, podName, containerName, cmd, config, clientSet, recorder, session)
+	if reason := session.Reason(); reason != "" {
+		log.Infof("Terminal session %s terminated: %s", session.Id, reason)
+		ws.Write([]byte("\r\n" + reason + "\r\n"))
+	} else if err != nil {
+		log.Errorf("Handler %s: %s", shell, err)
 	}
 	//err = Handler(ws, namespace, podName, containerName, "exit", config, clientSet)
 }
 
+// shell的简写转换成对应的命令
+func terminalShell(shell string) string {
+	switch shell {
+	case "bash", "sh", "ash":
+		return "/bin/" + shell
+	case "powershell":
+		return "powershell.exe"
+	case "cmd":
+		return "cmd.exe"
+	}
+	return shell
+}
+
+// 依次检查TerminalShells中的shell是否存在，Windows容器使用where，其他使用test -x或者which
+// 只根据探测命令的退出码判断，不依赖用户会话的退出状态
+func probeShell(namespace, podName, container string, prefix []string, config *restclient.Config, clientSet *kubernetes.Clientset) (string, error) {
+	for _, shell := range TerminalShells {
+		probe := []string{"which", shell}
+		if strings.HasSuffix(shell, ".exe") {
+			probe = []string{"where", shell}
+		} else if strings.HasPrefix(shell, "/") {
+			probe = []string{"test", "-x", shell}
+		}
+		err := execProbe(namespace, podName, container, append(append([]string{}, prefix...), probe...), config, clientSet)
+		if err == nil {
+			return shell, nil
+		}
+		if _, ok := err.(utilexec.CodeExitError); !ok {
+			return "", err
+		}
+		log.Infof("Shell %s is not available in %s/%s: %s", shell, podName, container, err)
+	}
+	return "", errors.New("no available shell found in container")
+}
+
+// 不分配TTY执行探测命令，丢弃输出
+func execProbe(namespace, podName, container string, cmd []string, config *restclient.Config, clientSet *kubernetes.Clientset) error {
+	req := clientSet.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(podName).
+		Namespace(namespace).
+		SubResource("exec")
+	req.VersionedParams(
+		&v1.PodExecOptions{
+			Container: container,
+			Command:   cmd,
+			Stdout:    true,
+			Stderr:    true,
+		},
+		scheme.ParameterCodec,
+	)
+	executor, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, req.URL())
+	if err != nil {
+		return err
+	}
+	return executor.Stream(remotecommand.StreamOptions{
+		Stdout: ioutil.Discard,
+		Stderr: ioutil.Discard,
+	})
+}
+
+func terminalAuditLog(params *handle.Resources, action common.ActionType, data interface{}) {
+	auditLog := handle.AuditLog{
+		Kind:       common.Pod,
+		ActionType: action,
+		Resources:  params,
+		Name:       params.Name,
+		PostData:   data,
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		log.Errorf("Terminal audit log error:%s; Name:%s", err, params.Name)
+	}
+}
+
 func getConfig(clusterId string) (*restclient.Config, error) {
 	cluster := common.ClusterDB{}
 	if err := db.GetById(common.Cluster, clusterId, &cluster); err != nil {
@@ -100,7 +329,7 @@ func getConfig(clusterId string) (*restclient.Config, error) {
 	}
 }
 
-func Handler(ws *websocket.Conn, namespace, podname, container, cmd string, config *restclient.Config, clientSet *kubernetes.Clientset) error {
+func Handler(ws *websocket.Conn, namespace, podname, container string, cmd []string, config *restclient.Config, clientSet *kubernetes.Clientset, recorder *resource.TerminalRecorder, session *resource.TerminalSession) error {
 	fn := func() error {
 		req := clientSet.CoreV1().RESTClient().Post().
 			Resource("pods").
@@ -114,11 +343,11 @@ func Handler(ws *websocket.Conn, namespace, podname, container, cmd string, conf
 		//Param("command", cmd).Param("tty", "true")
 		c := make(chan *remotecommand.TerminalSize)
 
-		t := &terminalSize{ws, c}
+		t := &terminalSize{conn: ws, sizeChan: c, recorder: recorder, session: session}
 		req.VersionedParams(
 			&v1.PodExecOptions{
 				Container: container,
-				Command:   []string{cmd},
+				Command:   cmd,
 				Stdin:     true,
 				Stdout:    true,
 				Stderr:    true,
@@ -126,8 +355,13 @@ func Handler(ws *websocket.Conn, namespace, podname, container, cmd string, conf
 			},
 			scheme.ParameterCodec,
 		)
-		executor, err := remotecommand.NewSPDYExecutor(
-			config, http.MethodPost, req.URL(),
+		transport, upgrader, err := spdy.RoundTripperFor(config)
+		if err != nil {
+			return err
+		}
+		// 记录SPDY连接，超时或者被管理员终止时关闭连接
+		executor, err := remotecommand.NewSPDYExecutorForTransports(
+			transport, session.Upgrader(upgrader), http.MethodPost, req.URL(),
 		)
 		if err != nil {
 			return err
@@ -135,8 +369,8 @@ func Handler(ws *websocket.Conn, namespace, podname, container, cmd string, conf
 
 		return executor.Stream(remotecommand.StreamOptions{
 			Stdin:             t,
-			Stdout:            ws,
-			Stderr:            ws,
+			Stdout:            recordWriter{ws, recorder, session},
+			Stderr:            recordWriter{ws, recorder, session},
 			Tty:               true,
 			TerminalSizeQueue: t,
 		})
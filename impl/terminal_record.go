@@ -0,0 +1,59 @@
+package impl
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"net/http"
+)
+
+const ReplayTerminalRecord = common.ActionType("replay_terminal_record")
+
+func ListTerminalRecord(c *gin.Context) {
+	responseData := HandleTerminalRecord(common.List, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+// 返回asciicast v2格式的录像文件，可以直接使用asciinema-player回放
+func ReplayTerminalRecordFile(c *gin.Context) {
+	responseData := HandleTerminalRecord(ReplayTerminalRecord, c)
+	if responseData.Code != http.StatusOK {
+		c.JSON(responseData.Code, responseData)
+		return
+	}
+	c.Header("Content-Type", "application/x-asciicast")
+	c.File(responseData.Data.(string))
+}
+
+func HandleTerminalRecord(action common.ActionType, c *gin.Context) (responseData *common.ResponseData) {
+	// 获取HTTP的参数，存到handle.Resources结构体中
+	commonParams := handle.GenerateCommonParams(c, nil)
+	r := resource.TerminalRecordResource{
+		Params: commonParams,
+		Pod:    c.Query("pod"),
+		User:   c.Query("user"),
+	}
+	// 调用结构体方法
+	switch action {
+	case common.List:
+		if err := resource.CheckNamespaceAccess(r.Params.User, r.Params.Product, r.Params.Cluster, r.Params.Namespace); err != nil {
+			return &common.ResponseData{Code: http.StatusForbidden, Msg: err.Error(), Data: ""}
+		}
+		response, err := r.List()
+		responseData = handle.HandlerResponse(response, err)
+	case ReplayTerminalRecord:
+		record, err := r.Get()
+		if err != nil {
+			return handle.HandlerResponse(nil, errors.New("terminal record does not exist"))
+		}
+		// 只能回放有权限访问的命名空间下的录像
+		if err := resource.CheckNamespaceAccess(r.Params.User, r.Params.Product, record.Cluster, record.Namespace); err != nil {
+			return &common.ResponseData{Code: http.StatusForbidden, Msg: err.Error(), Data: ""}
+		}
+		response, err := r.CastFile()
+		responseData = handle.HandlerResponse(response, err)
+	}
+	return
+}
@@ -0,0 +1,60 @@
+package impl
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"net/http"
+	"strconv"
+)
+
+func ListTerminalSession(c *gin.Context) {
+	responseData := HandleTerminalSession(common.List, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+// 强制终止终端会话
+func DeleteTerminalSession(c *gin.Context) {
+	responseData := HandleTerminalSession(common.Delete, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+// 批准或者撤销共享会话参与者的写权限
+func ApproveTerminalViewer(c *gin.Context) {
+	responseData := HandleTerminalSession(resource.TerminalApprove, c)
+	c.JSON(responseData.Code, responseData)
+}
+
+func HandleTerminalSession(action common.ActionType, c *gin.Context) (responseData *common.ResponseData) {
+	// 获取HTTP的参数，存到handle.Resources结构体中
+	commonParams := handle.GenerateCommonParams(c, nil)
+	approved, _ := strconv.ParseBool(c.Query("approved"))
+	r := resource.TerminalSessionResource{
+		Params:   commonParams,
+		Admin:    resource.CheckPlatformAdmin(commonParams.User) == nil,
+		Viewer:   c.Param("viewer"),
+		Approved: approved,
+	}
+	// 调用结构体方法
+	switch action {
+	case common.List:
+		response, err := r.List()
+		responseData = handle.HandlerResponse(response, err)
+	case common.Delete:
+		// 只有平台管理员可以终止其他用户的终端会话
+		if !r.Admin {
+			return &common.ResponseData{Code: http.StatusForbidden, Msg: "administrator permission required", Data: ""}
+		}
+		err := r.Delete()
+		responseData = handle.HandlerResponse(nil, err)
+	case resource.TerminalApprove:
+		if r.Viewer == "" {
+			return handle.HandlerResponse(nil, errors.New("viewer cannot be empty"))
+		}
+		err := r.Approve()
+		responseData = handle.HandlerResponse(nil, err)
+	}
+	return
+}
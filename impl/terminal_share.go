@@ -0,0 +1,81 @@
+package impl
+
+import (
+	"encoding/json"
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"golang.org/x/net/websocket"
+)
+
+const TerminalJoin = common.ActionType("terminal_join")
+
+// 通过会话ID加入其他用户正在运行的终端会话，默认只读，读写模式需要会话所有者批准
+func JoinTerminal(ws *websocket.Conn) {
+	defer func() {
+		ws.Close()
+		if err := recover(); err != nil {
+			log.Errorf("Join terminal panic: %s", err)
+		}
+	}()
+
+	c := ws.Request()
+	ws.PayloadType = websocket.BinaryFrame
+	session, err := resource.GetTerminalSession(c.FormValue("session"))
+	if err != nil {
+		ws.Write([]byte(err.Error() + "\r\n"))
+		return
+	}
+	// 握手前已经校验了cluster和namespace的权限，会话必须属于该命名空间
+	if session.Cluster != c.FormValue("cluster") || session.Namespace != c.FormValue("namespace") {
+		ws.Write([]byte("terminal session does not exist\r\n"))
+		return
+	}
+	params := &handle.Resources{
+		Namespace: session.Namespace,
+		Cluster:   session.Cluster,
+		Product:   c.FormValue("productId"),
+		Name:      session.Pod,
+		User:      webSocketUser(ws),
+	}
+	var userName string
+	if params.User != nil {
+		userName = params.User.Name
+	}
+	viewer, err := session.Join(userName, c.FormValue("mode"))
+	if err != nil {
+		ws.Write([]byte(err.Error() + "\r\n"))
+		return
+	}
+	defer session.Leave(viewer)
+	terminalAuditLog(params, TerminalJoin, map[string]interface{}{"session": session.Id, "owner": session.User, "viewer": viewer.Id, "mode": viewer.Mode})
+	if viewer.Mode == resource.TerminalReadWrite {
+		ws.Write([]byte("Waiting for the session owner to approve write access, viewer id: " + viewer.Id + "\r\n"))
+	}
+	// 参与者的输入，未被批准时忽略
+	go func() {
+		for {
+			var reply string
+			var msg map[string]uint16
+			if err := websocket.Message.Receive(ws, &reply); err != nil {
+				session.Leave(viewer)
+				return
+			}
+			// 窗口大小以会话所有者为准
+			if err := json.Unmarshal([]byte(reply), &msg); err == nil {
+				continue
+			}
+			if viewer.Mode == resource.TerminalReadWrite {
+				if err := session.ViewerInput(viewer, []byte(reply)); err != nil {
+					log.Infof("Terminal viewer %s input ignored: %s", viewer.Id, err)
+				}
+			}
+		}
+	}()
+	for data := range viewer.Output() {
+		if _, err := ws.Write(data); err != nil {
+			return
+		}
+	}
+}
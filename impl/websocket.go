@@ -0,0 +1,99 @@
+package impl
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-k8s/resource"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"github.com/open-kingfisher/king-utils/middleware/jwt"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"strings"
+)
+
+type webSocketUserKey struct{}
+
+// WebSocket握手前的认证和授权
+// 浏览器无法自定义WebSocket请求头，Token可以通过token参数或者Sec-WebSocket-Protocol子协议传递
+func WebSocketAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		responseData := common.ResponseData{
+			Msg:  "Unauthorized",
+			Data: "",
+			Code: http.StatusUnauthorized,
+		}
+		claims, err := parseWebSocketToken(c.Request)
+		if err != nil {
+			log.Errorf("Parse websocket token error: %s", err)
+			responseData.Msg = "Unauthorized " + err.Error()
+			c.AbortWithStatusJSON(http.StatusUnauthorized, responseData)
+			return
+		}
+		productId := c.Query("productId")
+		if productId == "" {
+			productId = claims.ProductId
+		}
+		if err := resource.CheckNamespaceAccess(claims, productId, c.Query("cluster"), c.Query("namespace")); err != nil {
+			log.Errorf("User %s websocket access denied: %s", claims.Name, err)
+			responseData.Code = http.StatusForbidden
+			responseData.Msg = "Forbidden " + err.Error()
+			c.AbortWithStatusJSON(http.StatusForbidden, responseData)
+			return
+		}
+		c.Set("user", claims)
+		// WebSocket处理函数只能拿到http.Request，通过context传递用户信息
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), webSocketUserKey{}, claims))
+	}
+}
+
+// 将WebSocket处理函数转换成gin的处理函数
+func ServeWebSocket(handler func(ws *websocket.Conn)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		server := websocket.Server{
+			Handler: handler,
+			Handshake: func(config *websocket.Config, req *http.Request) error {
+				// 客户端携带子协议时，服务端必须回应其中一个子协议，否则浏览器会断开连接
+				if len(config.Protocol) > 0 {
+					config.Protocol = config.Protocol[:1]
+				}
+				return nil
+			},
+		}
+		server.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// 获取WebSocket认证通过的用户
+func webSocketUser(ws *websocket.Conn) *jwt.CustomClaims {
+	if claims, ok := ws.Request().Context().Value(webSocketUserKey{}).(*jwt.CustomClaims); ok {
+		return claims
+	}
+	return nil
+}
+
+// 依次从token参数、X-Signing、Authorization请求头以及Sec-WebSocket-Protocol子协议中获取Token
+func parseWebSocketToken(req *http.Request) (*jwt.CustomClaims, error) {
+	j := jwt.JWT{
+		SigningKey: []byte(common.Signing),
+	}
+	tokens := []string{req.URL.Query().Get("token"), req.Header.Get(common.HeaderSigning), req.Header.Get("Authorization")}
+	for _, protocol := range strings.Split(req.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		tokens = append(tokens, strings.TrimSpace(protocol))
+	}
+	err := jwt.TokenInvalid
+	for _, token := range tokens {
+		if s := strings.Split(token, " "); len(s) == 2 {
+			token = s[1]
+		}
+		// JWT由三段组成
+		if strings.Count(token, ".") != 2 {
+			continue
+		}
+		var claims *jwt.CustomClaims
+		if claims, err = j.ParseToken(token); err == nil {
+			return claims, nil
+		}
+	}
+	return nil, err
+}
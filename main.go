@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"github.com/gin-gonic/gin"
+	"github.com/open-kingfisher/king-k8s/resource"
 	"github.com/open-kingfisher/king-k8s/router"
 	"github.com/open-kingfisher/king-utils/common"
 	"github.com/open-kingfisher/king-utils/common/log"
@@ -9,9 +11,31 @@ import (
 	"github.com/open-kingfisher/king-utils/config"
 	"github.com/open-kingfisher/king-utils/kit"
 	_ "github.com/open-kingfisher/king-utils/middleware/Validator"
+	"os"
+	"time"
 )
 
 func main() {
+	// 终端会话的超时时间以及并发限制，0表示不限制
+	cmd := flag.NewFlagSet("", flag.ExitOnError)
+	cmd.DurationVar(&resource.TerminalIdleTimeout, "terminalIdleTimeout", resource.TerminalIdleTimeout, "Terminal idle timeout")
+	cmd.DurationVar(&resource.TerminalMaxDuration, "terminalMaxDuration", resource.TerminalMaxDuration, "Terminal max session duration")
+	cmd.IntVar(&resource.TerminalUserLimit, "terminalUserLimit", resource.TerminalUserLimit, "Max concurrent terminal sessions per user")
+	cmd.IntVar(&resource.TerminalClusterLimit, "terminalClusterLimit", resource.TerminalClusterLimit, "Max concurrent terminal sessions per cluster")
+	// 调试、救援以及节点终端Pod的默认存活时间和最长存活时间
+	cmd.DurationVar(&resource.DebugSessionTTL, "debugSessionTTL", resource.DebugSessionTTL, "Default debug session ttl")
+	cmd.DurationVar(&resource.DebugSessionMaxTTL, "debugSessionMaxTTL", resource.DebugSessionMaxTTL, "Max debug session ttl")
+	// 关闭后有命名空间权限的用户也可以使用节点终端
+	cmd.BoolVar(&resource.NodeShellAdminOnly, "nodeShellAdminOnly", resource.NodeShellAdminOnly, "Only allow platform admins to open node shells")
+	// 上线失败自动回滚以及Pod健康检查的阈值
+	cmd.BoolVar(&resource.RolloutAutoRollbackEnabled, "rolloutAutoRollback", resource.RolloutAutoRollbackEnabled, "Rollback automatically when a rollout fails")
+	cmd.IntVar(&resource.RolloutMaxRestarts, "rolloutMaxRestarts", resource.RolloutMaxRestarts, "Max container restarts of new pods during a rollout, 0 means no limit")
+	cmd.DurationVar(&resource.RolloutReadinessTimeout, "rolloutReadinessTimeout", resource.RolloutReadinessTimeout, "Max time new pods may stay unready during a rollout, 0 means no limit")
+	cmd.Parse(os.Args[1:])
+	// 创建本服务使用的数据表
+	if err := resource.CreateTables(); err != nil {
+		log.Fatalf("Create table error: %v", err)
+	}
 	// Debug Mode
 	gin.SetMode(config.Mode)
 	g := gin.New()
@@ -24,6 +48,12 @@ func main() {
 		Handler:      &rabbitmq.UpdateKubeConfig{},
 	}
 	go consumer.Run()
+	// 清理过期的调试会话
+	go resource.DebugSessionReaper(time.Minute)
+	// 跟踪进行中的分步上线
+	go resource.RolloutReconciler(5 * time.Second)
+	// 执行定时扩缩容策略
+	go resource.ScaleScheduler()
 	// Listen and Server in 0.0.0.0:8080
 	if err := r.Run(config.Listen); err != nil {
 		log.Fatalf("Listen error: %v", err)
@@ -0,0 +1,235 @@
+package resource
+
+import (
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"io"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	yamlutil "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+	"sort"
+	"strings"
+)
+
+const (
+	Apply = common.ActionType("apply")
+	// server-side apply使用的field manager
+	ApplyFieldManager = "kingfisher"
+	// 每个对象的应用结果
+	ApplyCreated    = "created"
+	ApplyConfigured = "configured"
+	ApplyUnchanged  = "unchanged"
+	ApplyError      = "error"
+)
+
+// 命名空间和CRD先应用，同一个文件中的对象才能使用
+var applyOrder = map[string]int{
+	"Namespace":                0,
+	"CustomResourceDefinition": 1,
+}
+
+type ApplyResult struct {
+	Index      int    `json:"index"`
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	Result     string `json:"result"`
+	Error      string `json:"error,omitempty"`
+}
+
+type ApplyResource struct {
+	Params  *handle.Resources
+	Dynamic dynamic.Interface
+	// 和其它field manager冲突时强制覆盖
+	Force  bool
+	DryRun bool
+	// 平台管理员可以应用集群级别的对象以及任意命名空间的对象
+	Admin bool
+}
+
+// 解析多文档YAML，通过discovery获取资源类型后逐个server-side apply
+func (r *ApplyResource) Apply(manifest string) ([]*ApplyResult, error) {
+	objects, err := decodeManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, errors.New("manifest is empty")
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(r.Params.ClientSet.Discovery()))
+	order := make([]int, len(objects))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return applyPriority(objects[order[i]]) < applyPriority(objects[order[j]])
+	})
+	results := make([]*ApplyResult, len(objects))
+	for _, i := range order {
+		results[i] = r.applyObject(mapper, i, objects[i])
+	}
+	return results, nil
+}
+
+func (r *ApplyResource) applyObject(mapper *restmapper.DeferredDiscoveryRESTMapper, index int, object *unstructured.Unstructured) *ApplyResult {
+	result := &ApplyResult{
+		Index:      index,
+		APIVersion: object.GetAPIVersion(),
+		Kind:       object.GetKind(),
+		Namespace:  object.GetNamespace(),
+		Name:       object.GetName(),
+	}
+	if err := r.applyUnstructured(mapper, object, result); err != nil {
+		result.Result = ApplyError
+		result.Error = err.Error()
+		log.Errorf("Apply error:%s; Kind:%s; Namespace:%s; Name:%s", err, result.Kind, result.Namespace, result.Name)
+	}
+	return result
+}
+
+func (r *ApplyResource) applyUnstructured(mapper *restmapper.DeferredDiscoveryRESTMapper, object *unstructured.Unstructured, result *ApplyResult) error {
+	gvk := object.GroupVersionKind()
+	if gvk.Kind == "" || gvk.Version == "" {
+		return errors.New("apiVersion and kind are required")
+	}
+	if object.GetName() == "" {
+		return errors.New("metadata.name is required")
+	}
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		// 前面刚创建的CRD需要重新discovery
+		mapper.Reset()
+		mapping, err = mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return err
+	}
+	var client dynamic.ResourceInterface
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		namespace := object.GetNamespace()
+		if namespace == "" {
+			namespace = r.Params.Namespace
+		}
+		if namespace == "" {
+			return errors.New("namespace is required")
+		}
+		if !r.Admin {
+			if err := CheckNamespaceAccess(r.Params.User, r.Params.Product, r.Params.Cluster, namespace); err != nil {
+				return err
+			}
+		}
+		object.SetNamespace(namespace)
+		client = r.Dynamic.Resource(mapping.Resource).Namespace(namespace)
+	} else {
+		if !r.Admin {
+			return fmt.Errorf("%s is cluster scoped, only platform admin can apply it", gvk.Kind)
+		}
+		object.SetNamespace("")
+		client = r.Dynamic.Resource(mapping.Resource)
+	}
+	result.Namespace = object.GetNamespace()
+	// 从集群中导出的对象去掉服务端维护的字段后才能应用
+	for _, field := range []string{"resourceVersion", "uid", "selfLink", "creationTimestamp", "generation", "managedFields"} {
+		unstructured.RemoveNestedField(object.Object, "metadata", field)
+	}
+	unstructured.RemoveNestedField(object.Object, "status")
+	data, err := object.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	existing, err := client.Get(object.GetName(), metav1.GetOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	if err != nil {
+		existing = nil
+	}
+	options := metav1.PatchOptions{FieldManager: ApplyFieldManager, Force: &r.Force}
+	if r.DryRun {
+		options.DryRun = []string{metav1.DryRunAll}
+	}
+	applied, err := client.Patch(object.GetName(), types.ApplyPatchType, data, options)
+	if err != nil {
+		return err
+	}
+	switch {
+	case existing == nil:
+		result.Result = ApplyCreated
+	case apiequality.Semantic.DeepEqual(applyComparable(existing), applyComparable(applied)):
+		result.Result = ApplyUnchanged
+	default:
+		result.Result = ApplyConfigured
+	}
+	if r.DryRun || result.Result == ApplyUnchanged {
+		return nil
+	}
+	params := *r.Params
+	params.Namespace = object.GetNamespace()
+	auditLog := handle.AuditLog{
+		Kind:       strings.ToLower(gvk.Kind),
+		ActionType: Apply,
+		Resources:  &params,
+		Name:       object.GetName(),
+		PostData:   object.Object,
+	}
+	return auditLog.InsertAuditLog()
+}
+
+// 去掉每次应用都会变化的字段，用于判断对象是否有修改
+func applyComparable(object *unstructured.Unstructured) map[string]interface{} {
+	object = object.DeepCopy()
+	for _, field := range []string{"resourceVersion", "managedFields", "generation"} {
+		unstructured.RemoveNestedField(object.Object, "metadata", field)
+	}
+	return object.Object
+}
+
+// 按---分割的YAML或者JSON，List类型展开为多个对象
+func decodeManifest(manifest string) ([]*unstructured.Unstructured, error) {
+	decoder := yamlutil.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 4096)
+	objects := make([]*unstructured.Unstructured, 0)
+	for i := 1; ; i++ {
+		data := make(map[string]interface{})
+		if err := decoder.Decode(&data); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("document %d: %s", i, err)
+		}
+		if len(data) == 0 {
+			continue
+		}
+		object := &unstructured.Unstructured{Object: data}
+		if !object.IsList() {
+			objects = append(objects, object)
+			continue
+		}
+		if err := object.EachListItem(func(item runtime.Object) error {
+			if u, ok := item.(*unstructured.Unstructured); ok {
+				objects = append(objects, u)
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("document %d: %s", i, err)
+		}
+	}
+	return objects, nil
+}
+
+func applyPriority(object *unstructured.Unstructured) int {
+	if priority, ok := applyOrder[object.GetKind()]; ok {
+		return priority
+	}
+	return len(applyOrder)
+}
@@ -0,0 +1,101 @@
+package resource
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     []string
+		wantErr  bool
+	}{
+		{"multi document", `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: demo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: demo
+`, []string{"Namespace/demo", "ConfigMap/config"}, false},
+		// 空文档以及只有注释的文档被忽略
+		{"empty documents", `---
+# comment
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+---
+`, []string{"Service/web"}, false},
+		{"list", `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: token
+- apiVersion: apps/v1
+  kind: Deployment
+  metadata:
+    name: web
+`, []string{"Secret/token", "Deployment/web"}, false},
+		{"json", `{"apiVersion":"v1","kind":"ServiceAccount","metadata":{"name":"deployer"}}`, []string{"ServiceAccount/deployer"}, false},
+		{"empty", "", []string{}, false},
+		{"invalid", "apiVersion: v1\nkind: [", nil, true},
+	}
+	for _, test := range tests {
+		objects, err := decodeManifest(test.manifest)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: decodeManifest() error = %v, wantErr %v", test.name, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		got := make([]string, 0, len(objects))
+		for _, object := range objects {
+			got = append(got, object.GetKind()+"/"+object.GetName())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: decodeManifest() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestApplyComparable(t *testing.T) {
+	object := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":            "config",
+			"resourceVersion": "100",
+			"generation":      int64(2),
+			"managedFields":   []interface{}{map[string]interface{}{"manager": "kingfisher"}},
+			"labels":          map[string]interface{}{"app": "web"},
+		},
+		"data": map[string]interface{}{"key": "value"},
+	}}
+	changed := object.DeepCopy()
+	changed.SetResourceVersion("101")
+	changed.SetGeneration(3)
+	if !reflect.DeepEqual(applyComparable(object), applyComparable(changed)) {
+		t.Error("objects that differ only in resourceVersion and generation should be equal")
+	}
+	changed.SetLabels(map[string]string{"app": "api"})
+	if reflect.DeepEqual(applyComparable(object), applyComparable(changed)) {
+		t.Error("objects with different labels should not be equal")
+	}
+	// 不修改原对象
+	if object.GetResourceVersion() != "100" || len(object.GetManagedFields()) != 1 {
+		t.Errorf("applyComparable modified the object: %v", object.Object)
+	}
+}
@@ -0,0 +1,65 @@
+package resource
+
+import (
+	"errors"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/db"
+	"github.com/open-kingfisher/king-utils/middleware/jwt"
+)
+
+// 平台管理员角色
+const PlatformAdmin = "admin"
+
+// 校验用户是否有权限访问集群中的命名空间
+// 用户需要被授权该集群和命名空间，指定产品时用户需要属于该产品并且产品包含该集群和命名空间
+func CheckNamespaceAccess(claims *jwt.CustomClaims, productId, cluster, namespace string) error {
+	if claims == nil {
+		return errors.New("unauthorized")
+	}
+	user := common.User{}
+	if err := db.GetById(common.UserTable, claims.ID, &user); err != nil {
+		return errors.New("user does not exist")
+	}
+	if !sliceContain(cluster, user.Cluster) {
+		return errors.New("no permission to access cluster")
+	}
+	namespaceId, err := getNamespaceId(cluster, namespace)
+	if err != nil {
+		return err
+	}
+	if namespaceId == "" || !sliceContain(namespaceId, user.Namespace) {
+		return errors.New("no permission to access namespace")
+	}
+	if productId != "" {
+		if !sliceContain(productId, user.Product) {
+			return errors.New("user does not belong to product")
+		}
+		product := common.ProductDB{}
+		if err := db.GetById(common.ProductTable, productId, &product); err != nil {
+			return errors.New("product does not exist")
+		}
+		if !sliceContain(cluster, product.Cluster) || !sliceContain(namespaceId, product.Namespace) {
+			return errors.New("namespace does not belong to product")
+		}
+	}
+	return nil
+}
+
+// 校验用户是否为平台管理员
+func CheckPlatformAdmin(claims *jwt.CustomClaims) error {
+	if claims == nil {
+		return errors.New("unauthorized")
+	}
+	user := common.User{}
+	if err := db.GetById(common.UserTable, claims.ID, &user); err != nil {
+		return errors.New("user does not exist")
+	}
+	role := common.PlatformRoleDB{}
+	if err := db.GetById(common.PlatformRoleTable, user.Role, &role); err != nil {
+		return errors.New("platform role does not exist")
+	}
+	if role.Id != PlatformAdmin && role.Name != PlatformAdmin {
+		return errors.New("administrator permission required")
+	}
+	return nil
+}
@@ -0,0 +1,363 @@
+package resource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"k8s.io/api/apps/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"time"
+)
+
+const (
+	RolloutBlueGreen = "bluegreen"
+	BlueGreenStart   = common.ActionType("blue_green")
+	// 新旧版本的Pod使用不同的颜色标签，Service通过此标签一次性切换
+	BlueGreenColorLabel = "kingfisher.io/color"
+	BlueGreenBlue       = "blue"
+	BlueGreenGreen      = "green"
+	// deploying为等待新版本就绪，warm为已经切换流量，旧版本保持运行
+	BlueGreenPhaseDeploying = "deploying"
+	BlueGreenPhaseWarm      = "warm"
+)
+
+type BlueGreenConfig struct {
+	// 切换后旧版本保持运行的时间，单位秒，0表示切换后立即缩容
+	WarmWindow int64 `json:"warmWindow"`
+	// 以下由服务填写
+	ActiveName string `json:"activeName"`
+	TargetName string `json:"targetName"`
+	Color      string `json:"color"`
+	// 切换前的Service选择器，失败或者终止时恢复
+	Selectors      map[string]map[string]string `json:"selectors"`
+	ActiveReplicas int32                        `json:"activeReplicas"`
+	Phase          string                       `json:"phase"`
+	SwitchTime     int64                        `json:"switchTime"`
+}
+
+type BlueGreenPostData struct {
+	Patches []common.PatchData `json:"patches"`
+	BlueGreenConfig
+}
+
+// 开始蓝绿发布，新版本作为另外一个Deployment部署，就绪后一次性切换Service选择器
+// Name为基础名称，新版本的Deployment名称为<name>-blue或者<name>-green
+func (r *ControllerResource) StartBlueGreen(postData *BlueGreenPostData) (*RolloutDB, error) {
+	if r.Params.Controller != "deployment" {
+		return nil, errors.New("blue/green release only supports deployment")
+	}
+	if len(postData.Patches) == 0 {
+		return nil, errors.New("patches cannot be empty")
+	}
+	config := postData.BlueGreenConfig
+	if config.WarmWindow < 0 {
+		return nil, errors.New("warm window cannot be negative")
+	}
+	base, err := r.assertDeployment()
+	if err != nil {
+		return nil, err
+	}
+	services, err := r.blueGreenServices(base)
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, errors.New("no service selects the deployment")
+	}
+	// 当前Service选择器中的颜色即为线上版本，没有颜色时线上版本为基础Deployment
+	config.Selectors = make(map[string]map[string]string)
+	activeColor := ""
+	for _, name := range services {
+		service, err := r.Params.ClientSet.CoreV1().Services(r.Params.Namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		config.Selectors[name] = service.Spec.Selector
+		if color := service.Spec.Selector[BlueGreenColorLabel]; color != "" {
+			if activeColor != "" && activeColor != color {
+				return nil, fmt.Errorf("services of %s select different colors", r.Params.Name)
+			}
+			activeColor = color
+		}
+	}
+	config.ActiveName = r.Params.Name
+	config.Color = BlueGreenGreen
+	if activeColor != "" {
+		config.ActiveName = r.Params.Name + "-" + activeColor
+		if activeColor == BlueGreenGreen {
+			config.Color = BlueGreenBlue
+		}
+	}
+	config.TargetName = r.Params.Name + "-" + config.Color
+	active, err := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Get(config.ActiveName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	config.ActiveReplicas = *active.Spec.Replicas
+	config.Phase = BlueGreenPhaseDeploying
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+	rollout := r.newRollout(deploymentRevision(active), postData.Patches)
+	rollout.Strategy = RolloutBlueGreen
+	rollout.BlueGreen = &config
+	rollout.Replicas = config.ActiveReplicas
+	rollout.TotalSteps = 2
+	if err := r.createRollout(rollout); err != nil {
+		return nil, err
+	}
+	if err := r.deployBlueGreen(rollout, active); err != nil {
+		// 回滚失败时Service可能仍然选择新版本的pod-template-hash，记录到失败信息中
+		message := err.Error()
+		if rollbackErr := r.rollbackBlueGreen(rollout); rollbackErr != nil {
+			message = fmt.Sprintf("%s, rollback failed: %s", message, rollbackErr)
+		}
+		rollout.transition(RolloutFailed, message)
+		if err := saveRollout(rollout); err != nil {
+			log.Errorf("Blue green rollout save error:%s; Message:%s", err, message)
+		}
+		return nil, errors.New(message)
+	}
+	rollout.transition(RolloutProgressing, fmt.Sprintf("deploying %s", config.TargetName))
+	if err := saveRollout(rollout); err != nil {
+		return nil, err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Deployment,
+		ActionType: BlueGreenStart,
+		Resources:  r.Params,
+		Name:       r.Params.Name,
+		PostData:   postData,
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return nil, err
+	}
+	return rollout, nil
+}
+
+// 先把Service固定到线上版本的Pod，再以线上版本为模板创建新版本，避免新版本就绪前接收流量
+func (r *ControllerResource) deployBlueGreen(rollout *RolloutDB, active *v1.Deployment) error {
+	config := rollout.BlueGreen
+	if active.Spec.Template.Labels[BlueGreenColorLabel] == "" {
+		hash, err := r.stableTemplateHash(active)
+		if err != nil {
+			return err
+		}
+		for name, selector := range config.Selectors {
+			pinned := map[string]string{v1.DefaultDeploymentUniqueLabelKey: hash}
+			for k, v := range selector {
+				pinned[k] = v
+			}
+			if err := r.updateServiceSelector(name, pinned); err != nil {
+				return err
+			}
+		}
+	}
+	deployments := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace)
+	if old, err := deployments.Get(config.TargetName, metav1.GetOptions{}); err == nil {
+		// 上一次发布留下的旧版本，副本数为0时直接删除重新创建
+		if old.Status.Replicas > 0 || *old.Spec.Replicas > 0 {
+			return fmt.Errorf("deployment %s is still running", config.TargetName)
+		}
+		if err := deployments.Delete(config.TargetName, &metav1.DeleteOptions{}); err != nil {
+			return err
+		}
+		if err := waitDeploymentDeleted(r, config.TargetName); err != nil {
+			return err
+		}
+	} else if !k8serrors.IsNotFound(err) {
+		return err
+	}
+	replicas := config.ActiveReplicas
+	target := &v1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        config.TargetName,
+			Namespace:   r.Params.Namespace,
+			Labels:      map[string]string{},
+			Annotations: map[string]string{RolloutAnnotation: rollout.Id},
+		},
+		Spec: *active.Spec.DeepCopy(),
+	}
+	for k, v := range active.Labels {
+		target.Labels[k] = v
+	}
+	target.Labels[BlueGreenColorLabel] = config.Color
+	target.Spec.Replicas = &replicas
+	target.Spec.Paused = false
+	target.Spec.Selector.MatchLabels = setColor(target.Spec.Selector.MatchLabels, config.Color)
+	target.Spec.Template.Labels = setColor(target.Spec.Template.Labels, config.Color)
+	if _, err := deployments.Create(target); err != nil {
+		log.Errorf("Blue/green deployment create error:%s; Name:%s", err, config.TargetName)
+		return err
+	}
+	data, err := json.Marshal(rollout.Patches)
+	if err != nil {
+		return err
+	}
+	if _, err := deployments.Patch(config.TargetName, types.JSONPatchType, data); err != nil {
+		log.Errorf("Blue/green deployment patch error:%s; Json:%s; Name:%s", err, string(data), config.TargetName)
+		return err
+	}
+	return nil
+}
+
+// 通过ServiceResource.Update修改选择器，保留审计记录
+func (r *ControllerResource) updateServiceSelector(name string, selector map[string]string) error {
+	params := *r.Params
+	params.Name = name
+	service := &ServiceResource{Params: &params}
+	old, err := service.Get()
+	if err != nil {
+		return err
+	}
+	old.Spec.Selector = selector
+	service.PostData = old
+	_, err = service.Update()
+	return err
+}
+
+func reconcileBlueGreen(r *ControllerResource, rollout *RolloutDB) error {
+	config := rollout.BlueGreen
+	rollout.ModifyTime = time.Now().Unix()
+	if rollout.State == RolloutPending {
+		// 创建记录后服务中断，无法确定新版本是否已经创建，恢复Service后标记失败
+		return failBlueGreen(r, rollout, "interrupted before deploying")
+	}
+	deployments := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace)
+	target, err := deployments.Get(config.TargetName, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return failBlueGreen(r, rollout, fmt.Sprintf("deployment %s not found", config.TargetName))
+		}
+		return err
+	}
+	switch config.Phase {
+	case BlueGreenPhaseDeploying:
+		if reason, err := r.rolloutHealth(target); err != nil {
+			return err
+		} else if reason != "" {
+			return failBlueGreen(r, rollout, fmt.Sprintf("deployment %s %s", config.TargetName, reason))
+		}
+		status := target.Status
+		rollout.UpdatedReplicas = status.AvailableReplicas
+		if target.Generation > status.ObservedGeneration || status.UpdatedReplicas < *target.Spec.Replicas ||
+			status.AvailableReplicas < *target.Spec.Replicas || status.Replicas != status.UpdatedReplicas {
+			return saveRollout(rollout)
+		}
+		// 新版本全部就绪，一次性切换所有Service
+		for name, selector := range config.Selectors {
+			if err := r.updateServiceSelector(name, setColor(selector, config.Color)); err != nil {
+				return err
+			}
+		}
+		if uid, err := r.getLatestReplica(string(target.UID)); err == nil {
+			if podIP, err := r.getLatestReplicaPodIp(uid); err == nil {
+				rollout.PodIP = podIP
+			}
+		}
+		config.Phase = BlueGreenPhaseWarm
+		config.SwitchTime = time.Now().Unix()
+		rollout.CurrentStep = 2
+		rollout.transition(RolloutProgressing, fmt.Sprintf("traffic switched to %s, keep %s warm for %ds", config.TargetName, config.ActiveName, config.WarmWindow))
+		return saveRollout(rollout)
+	case BlueGreenPhaseWarm:
+		// 保温期间新版本不健康时切回仍然保留的旧版本
+		if reason, err := r.rolloutHealth(target); err != nil {
+			return err
+		} else if reason != "" {
+			return failBlueGreen(r, rollout, fmt.Sprintf("deployment %s %s", config.TargetName, reason))
+		}
+		if time.Now().Unix()-config.SwitchTime < config.WarmWindow {
+			return saveRollout(rollout)
+		}
+		if err := scaleDeployment(r, config.ActiveName, 0); err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+		rollout.transition(RolloutCompleted, fmt.Sprintf("%s scaled down", config.ActiveName))
+		return saveRollout(rollout)
+	}
+	return nil
+}
+
+func failBlueGreen(r *ControllerResource, rollout *RolloutDB, message string) error {
+	if err := r.rollbackBlueGreen(rollout); err != nil {
+		message = fmt.Sprintf("%s, rollback failed: %s", message, err)
+	} else if rollout.BlueGreen.Phase == BlueGreenPhaseWarm {
+		message = message + ", traffic switched back to " + rollout.BlueGreen.ActiveName
+	} else {
+		message = message + ", traffic kept on " + rollout.BlueGreen.ActiveName
+	}
+	rollout.transition(RolloutFailed, message)
+	notifyRollout(r, rollout, message)
+	return saveRollout(rollout)
+}
+
+// 恢复切换前的Service选择器以及旧版本的副本数，然后删除新版本
+func (r *ControllerResource) rollbackBlueGreen(rollout *RolloutDB) error {
+	config := rollout.BlueGreen
+	if err := scaleDeployment(r, config.ActiveName, config.ActiveReplicas); err != nil {
+		return err
+	}
+	for name, selector := range config.Selectors {
+		if err := r.updateServiceSelector(name, selector); err != nil {
+			return err
+		}
+	}
+	err := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Delete(config.TargetName, &metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func waitDeploymentDeleted(r *ControllerResource, name string) error {
+	for i := 0; i < 60; i++ {
+		if _, err := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Get(name, metav1.GetOptions{}); k8serrors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("deployment %s is not deleted within 1 minute", name)
+}
+
+// 忽略颜色以及pod-template-hash后，选择器和基础Deployment的Pod模板标签匹配的Service
+func (r *ControllerResource) blueGreenServices(base *v1.Deployment) ([]string, error) {
+	services, err := r.Params.ClientSet.CoreV1().Services(r.Params.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, service := range services.Items {
+		if blueGreenServiceMatch(service.Spec.Selector, base.Spec.Template.Labels) {
+			names = append(names, service.Name)
+		}
+	}
+	return names, nil
+}
+
+func blueGreenServiceMatch(serviceSelector, templateLabels map[string]string) bool {
+	if len(serviceSelector) == 0 {
+		return false
+	}
+	selector := setColor(serviceSelector, "")
+	delete(selector, BlueGreenColorLabel)
+	return len(selector) > 0 && labels.SelectorFromSet(selector).Matches(labels.Set(templateLabels))
+}
+
+// 去掉固定用的pod-template-hash，加上颜色标签
+func setColor(selector map[string]string, color string) map[string]string {
+	res := map[string]string{BlueGreenColorLabel: color}
+	for k, v := range selector {
+		if k != BlueGreenColorLabel && k != v1.DefaultDeploymentUniqueLabelKey {
+			res[k] = v
+		}
+	}
+	return res
+}
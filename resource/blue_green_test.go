@@ -0,0 +1,63 @@
+package resource
+
+import (
+	"k8s.io/api/apps/v1"
+	"reflect"
+	"testing"
+)
+
+func TestSetColor(t *testing.T) {
+	tests := []struct {
+		selector map[string]string
+		color    string
+		want     map[string]string
+	}{
+		{
+			map[string]string{"app": "nginx"},
+			BlueGreenGreen,
+			map[string]string{"app": "nginx", BlueGreenColorLabel: BlueGreenGreen},
+		},
+		// 切换时替换颜色并去掉固定的pod-template-hash
+		{
+			map[string]string{"app": "nginx", BlueGreenColorLabel: BlueGreenBlue, v1.DefaultDeploymentUniqueLabelKey: "5d4f8"},
+			BlueGreenGreen,
+			map[string]string{"app": "nginx", BlueGreenColorLabel: BlueGreenGreen},
+		},
+		{nil, BlueGreenBlue, map[string]string{BlueGreenColorLabel: BlueGreenBlue}},
+	}
+	for _, test := range tests {
+		original := make(map[string]string)
+		for k, v := range test.selector {
+			original[k] = v
+		}
+		if got := setColor(test.selector, test.color); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("setColor(%v, %q) = %v, want %v", test.selector, test.color, got, test.want)
+		}
+		if len(test.selector) > 0 && !reflect.DeepEqual(test.selector, original) {
+			t.Errorf("setColor modified the selector: %v", test.selector)
+		}
+	}
+}
+
+func TestBlueGreenServiceMatch(t *testing.T) {
+	templateLabels := map[string]string{"app": "nginx", "tier": "web"}
+	tests := []struct {
+		name     string
+		selector map[string]string
+		want     bool
+	}{
+		{"match", map[string]string{"app": "nginx"}, true},
+		{"match all labels", map[string]string{"app": "nginx", "tier": "web"}, true},
+		// 已经切换过的Service带有颜色以及pod-template-hash
+		{"switched", map[string]string{"app": "nginx", BlueGreenColorLabel: BlueGreenGreen, v1.DefaultDeploymentUniqueLabelKey: "5d4f8"}, true},
+		{"other app", map[string]string{"app": "redis"}, false},
+		{"extra label", map[string]string{"app": "nginx", "version": "v2"}, false},
+		{"empty selector", nil, false},
+		{"only color", map[string]string{BlueGreenColorLabel: BlueGreenBlue}, false},
+	}
+	for _, test := range tests {
+		if got := blueGreenServiceMatch(test.selector, templateLabels); got != test.want {
+			t.Errorf("%s: blueGreenServiceMatch(%v) = %v, want %v", test.name, test.selector, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package resource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	RolloutCanary = "canary"
+	CanaryStart   = common.ActionType("canary")
+	CanarySuffix  = "-canary"
+	// 金丝雀Pod带有此标签，金丝雀Deployment的selector也加上此标签，避免选中稳定版本的Pod
+	CanaryTrackLabel = "kingfisher.io/track"
+	CanaryTrack      = "canary"
+	// 金丝雀的阶段，step为按权重逐步放量，promoting为全量更新稳定版本
+	CanaryPhaseStep      = "step"
+	CanaryPhasePromoting = "promoting"
+	// 每一步默认观察时间，单位秒
+	CanaryDefaultInterval = 60
+)
+
+var (
+	virtualServiceResource  = schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1alpha3", Resource: "virtualservices"}
+	destinationRuleResource = schema.GroupVersionResource{Group: "networking.istio.io", Version: "v1alpha3", Resource: "destinationrules"}
+)
+
+// 每一步放量后执行的Prometheus查询，结果需要在Min和Max之间
+// 查询中可以使用{{namespace}}、{{name}}、{{canary}}，分别替换为命名空间、Deployment名称、金丝雀Deployment名称
+type CanaryAnalysis struct {
+	Name  string   `json:"name"`
+	Query string   `json:"query"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+}
+
+type CanaryConfig struct {
+	// 每一步的流量百分比，递增，例如[10, 30, 50]，最后一步通过后全量
+	Weights []int32 `json:"weights"`
+	// 每一步放量后等待多少秒再进行分析
+	Interval int64            `json:"interval"`
+	Analysis []CanaryAnalysis `json:"analysis"`
+	// 以下由服务填写，命名空间开启istio注入时使用VirtualService按权重分流，否则按副本数比例分流
+	Istio          bool     `json:"istio"`
+	Services       []string `json:"services"`
+	StableReplicas int32    `json:"stableReplicas"`
+	StableHash     string   `json:"stableHash"`
+	Weight         int32    `json:"weight"`
+	Phase          string   `json:"phase"`
+	StepStart      int64    `json:"stepStart"`
+}
+
+type CanaryPostData struct {
+	Patches []common.PatchData `json:"patches"`
+	CanaryConfig
+}
+
+// 开始金丝雀发布，创建金丝雀Deployment并放量到第一步，后续由RolloutReconciler分析、放量以及全量或回滚
+func (r *ControllerResource) StartCanary(postData *CanaryPostData) (*RolloutDB, error) {
+	if r.Params.Controller != "deployment" {
+		return nil, errors.New("canary release only supports deployment")
+	}
+	config := postData.CanaryConfig
+	if len(postData.Patches) == 0 {
+		return nil, errors.New("patches cannot be empty")
+	}
+	if len(config.Weights) == 0 {
+		return nil, errors.New("weights cannot be empty")
+	}
+	for i, w := range config.Weights {
+		if w <= 0 || w > 100 || (i > 0 && w <= config.Weights[i-1]) {
+			return nil, errors.New("weights must be increasing and between 1 and 100")
+		}
+	}
+	for _, analysis := range config.Analysis {
+		if analysis.Query == "" || (analysis.Min == nil && analysis.Max == nil) {
+			return nil, fmt.Errorf("analysis %s needs a query and min or max", analysis.Name)
+		}
+	}
+	if config.Interval <= 0 {
+		config.Interval = CanaryDefaultInterval
+	}
+	deployment, err := r.assertDeployment()
+	if err != nil {
+		return nil, err
+	}
+	if deployment.Spec.Paused {
+		return nil, errors.New("cannot start canary on a paused deployment, resume it first")
+	}
+	if config.Istio, err = r.GetNamespaceIsIstioInjected(); err != nil {
+		return nil, err
+	}
+	if config.Services, err = r.matchServices(deployment); err != nil {
+		return nil, err
+	}
+	if config.Istio {
+		if config.StableHash, err = r.stableTemplateHash(deployment); err != nil {
+			return nil, err
+		}
+	} else {
+		// 按副本数分配流量时需要缩容稳定版本，HPA会把副本数改回去
+		hpa, err := r.scaleTargetHPA()
+		if err != nil {
+			return nil, err
+		}
+		if len(hpa) > 0 {
+			return nil, fmt.Errorf("%s is managed by HPA %s, canary without istio cannot scale it", r.Params.Name, strings.Join(hpa, ","))
+		}
+	}
+	config.StableReplicas = *deployment.Spec.Replicas
+	config.Phase = CanaryPhaseStep
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+	rollout := r.newRollout(deploymentRevision(deployment), postData.Patches)
+	rollout.Strategy = RolloutCanary
+	rollout.Canary = &config
+	rollout.Replicas = config.StableReplicas
+	rollout.TotalSteps = int32(len(config.Weights))
+	if err := r.createRollout(rollout); err != nil {
+		return nil, err
+	}
+	if err := r.startCanaryStep(rollout); err != nil {
+		rollout.transition(RolloutFailed, err.Error())
+		r.rollbackCanary(rollout)
+		saveRollout(rollout)
+		return nil, err
+	}
+	if err := saveRollout(rollout); err != nil {
+		return nil, err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Deployment,
+		ActionType: CanaryStart,
+		Resources:  r.Params,
+		Name:       r.Params.Name,
+		PostData:   postData,
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return nil, err
+	}
+	return rollout, nil
+}
+
+// 命名空间是否开启了istio注入
+func (r *ControllerResource) GetNamespaceIsIstioInjected() (bool, error) {
+	params := *r.Params
+	params.Name = "istio"
+	return (&ControllerResource{Params: &params}).GetNamespaceIsExistLabel()
+}
+
+// 创建或者更新金丝雀Deployment，并设置当前步骤的流量
+func (r *ControllerResource) startCanaryStep(rollout *RolloutDB) error {
+	config := rollout.Canary
+	if err := r.ensureCanaryDeployment(rollout); err != nil {
+		return err
+	}
+	config.Weight = config.Weights[rollout.CurrentStep-1]
+	config.StepStart = time.Now().Unix()
+	if err := r.applyCanaryWeight(rollout); err != nil {
+		return err
+	}
+	rollout.transition(RolloutProgressing, fmt.Sprintf("step %d/%d, canary weight %d%%", rollout.CurrentStep, rollout.TotalSteps, config.Weight))
+	return nil
+}
+
+// 以稳定版本为模板创建金丝雀Deployment，然后应用上线的patch
+func (r *ControllerResource) ensureCanaryDeployment(rollout *RolloutDB) error {
+	deployments := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace)
+	name := r.Params.Name + CanarySuffix
+	// 只复用本次上线创建的金丝雀Deployment，同名的其它Deployment不能修改
+	if existing, err := deployments.Get(name, metav1.GetOptions{}); err == nil {
+		if existing.Annotations[RolloutAnnotation] != rollout.Id {
+			return fmt.Errorf("deployment %s already exists and was not created by rollout %s", name, rollout.Id)
+		}
+		return nil
+	} else if !k8serrors.IsNotFound(err) {
+		return err
+	}
+	stable, err := r.assertDeployment()
+	if err != nil {
+		return err
+	}
+	replicas := int32(0)
+	canary := &v1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   r.Params.Namespace,
+			Labels:      map[string]string{CanaryTrackLabel: CanaryTrack},
+			Annotations: map[string]string{RolloutAnnotation: rollout.Id},
+		},
+		Spec: *stable.Spec.DeepCopy(),
+	}
+	for k, v := range stable.Labels {
+		canary.Labels[k] = v
+	}
+	canary.Spec.Replicas = &replicas
+	canary.Spec.Paused = false
+	canary.Spec.Selector = stable.Spec.Selector.DeepCopy()
+	if canary.Spec.Selector.MatchLabels == nil {
+		canary.Spec.Selector.MatchLabels = make(map[string]string)
+	}
+	canary.Spec.Selector.MatchLabels[CanaryTrackLabel] = CanaryTrack
+	if canary.Spec.Template.Labels == nil {
+		canary.Spec.Template.Labels = make(map[string]string)
+	}
+	canary.Spec.Template.Labels[CanaryTrackLabel] = CanaryTrack
+	if _, err := deployments.Create(canary); err != nil {
+		log.Errorf("Canary deployment create error:%s; Name:%s", err, name)
+		return err
+	}
+	data, err := json.Marshal(rollout.Patches)
+	if err != nil {
+		return err
+	}
+	if _, err := deployments.Patch(name, types.JSONPatchType, data); err != nil {
+		log.Errorf("Canary deployment patch error:%s; Json:%s; Name:%s", err, string(data), name)
+		return err
+	}
+	return nil
+}
+
+// 副本数按权重计算，istio模式下稳定版本副本数不变，由VirtualService分配流量
+func (r *ControllerResource) applyCanaryWeight(rollout *RolloutDB) error {
+	config := rollout.Canary
+	canaryReplicas := int32(math.Ceil(float64(config.StableReplicas) * float64(config.Weight) / 100))
+	if canaryReplicas < 1 {
+		canaryReplicas = 1
+	}
+	if err := scaleDeployment(r, r.Params.Name+CanarySuffix, canaryReplicas); err != nil {
+		return err
+	}
+	if config.Istio {
+		return r.applyCanaryRoute(rollout)
+	}
+	stableReplicas := config.StableReplicas - canaryReplicas
+	if stableReplicas < 0 {
+		stableReplicas = 0
+	}
+	return scaleDeployment(r, r.Params.Name, stableReplicas)
+}
+
+// 为每个Service创建DestinationRule和VirtualService，稳定版本通过pod-template-hash区分
+func (r *ControllerResource) applyCanaryRoute(rollout *RolloutDB) error {
+	dynamicClient, err := access.DynamicClient(r.Params.Cluster)
+	if err != nil {
+		return err
+	}
+	config := rollout.Canary
+	for _, service := range config.Services {
+		name := service + CanarySuffix
+		destinationRule := map[string]interface{}{
+			"host": service,
+			"subsets": []interface{}{
+				map[string]interface{}{"name": "stable", "labels": map[string]interface{}{v1.DefaultDeploymentUniqueLabelKey: config.StableHash}},
+				map[string]interface{}{"name": CanaryTrack, "labels": map[string]interface{}{CanaryTrackLabel: CanaryTrack}},
+			},
+		}
+		if err := r.upsertIstioObject(dynamicClient.Resource(destinationRuleResource).Namespace(r.Params.Namespace), "DestinationRule", name, rollout.Id, destinationRule); err != nil {
+			return err
+		}
+		virtualService := map[string]interface{}{
+			"hosts": []interface{}{service},
+			"http": []interface{}{
+				map[string]interface{}{
+					"route": []interface{}{
+						map[string]interface{}{"destination": map[string]interface{}{"host": service, "subset": "stable"}, "weight": int64(100 - config.Weight)},
+						map[string]interface{}{"destination": map[string]interface{}{"host": service, "subset": CanaryTrack}, "weight": int64(config.Weight)},
+					},
+				},
+			},
+		}
+		if err := r.upsertIstioObject(dynamicClient.Resource(virtualServiceResource).Namespace(r.Params.Namespace), "VirtualService", name, rollout.Id, virtualService); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ControllerResource) upsertIstioObject(client dynamic.ResourceInterface, kind, name, rolloutId string, spec map[string]interface{}) error {
+	object := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1alpha3",
+		"kind":       kind,
+		"metadata": map[string]interface{}{
+			"name":        name,
+			"namespace":   r.Params.Namespace,
+			"annotations": map[string]interface{}{RolloutAnnotation: rolloutId},
+		},
+		"spec": spec,
+	}}
+	existing, err := client.Get(name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = client.Create(object, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+	if existing.GetAnnotations()[RolloutAnnotation] == "" {
+		return fmt.Errorf("%s %s already exists and is not managed by canary release", kind, name)
+	}
+	object.SetResourceVersion(existing.GetResourceVersion())
+	_, err = client.Update(object, metav1.UpdateOptions{})
+	return err
+}
+
+// 回滚金丝雀，恢复稳定版本的副本数并删除金丝雀Deployment以及istio路由
+func (r *ControllerResource) rollbackCanary(rollout *RolloutDB) error {
+	config := rollout.Canary
+	var errs []string
+	if err := scaleDeployment(r, r.Params.Name, config.StableReplicas); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := r.deleteCanary(rollout); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (r *ControllerResource) deleteCanary(rollout *RolloutDB) error {
+	if err := r.deleteCanaryRoute(rollout); err != nil {
+		return err
+	}
+	deployments := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace)
+	canary, err := deployments.Get(r.Params.Name+CanarySuffix, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// 不删除其它上线或者用户创建的同名Deployment
+	if canary.Annotations[RolloutAnnotation] != rollout.Id {
+		return nil
+	}
+	err = deployments.Delete(canary.Name, &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &canary.UID}})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// 删除istio路由，流量恢复为Service按Pod均匀分配
+func (r *ControllerResource) deleteCanaryRoute(rollout *RolloutDB) error {
+	if !rollout.Canary.Istio {
+		return nil
+	}
+	dynamicClient, err := access.DynamicClient(r.Params.Cluster)
+	if err != nil {
+		return err
+	}
+	for _, service := range rollout.Canary.Services {
+		for _, gvr := range []schema.GroupVersionResource{virtualServiceResource, destinationRuleResource} {
+			if err := dynamicClient.Resource(gvr).Namespace(r.Params.Namespace).Delete(service+CanarySuffix, &metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 金丝雀由RolloutReconciler推进：等待金丝雀可用，观察时间到达后分析，通过则放量或者全量，失败则回滚
+func reconcileCanary(r *ControllerResource, rollout *RolloutDB, stable *v1.Deployment) error {
+	config := rollout.Canary
+	rollout.ModifyTime = time.Now().Unix()
+	if rollout.State == RolloutPending {
+		// 创建记录后服务中断，重新开始第一步
+		if err := r.startCanaryStep(rollout); err != nil {
+			return failCanary(r, rollout, err.Error())
+		}
+		return saveRollout(rollout)
+	}
+	if config.Phase == CanaryPhasePromoting {
+		status := stable.Status
+		if deploymentFailed(stable) {
+			rollout.transition(RolloutFailed, "promote failed: progress deadline exceeded")
+			return saveRollout(rollout)
+		}
+		if stable.Generation > status.ObservedGeneration || status.UpdatedReplicas < config.StableReplicas ||
+			status.AvailableReplicas < config.StableReplicas || status.Replicas != status.UpdatedReplicas {
+			return saveRollout(rollout)
+		}
+		if err := r.deleteCanary(rollout); err != nil {
+			return err
+		}
+		rollout.CurrentStep = rollout.TotalSteps
+		rollout.transition(RolloutCompleted, "canary promoted")
+		return saveRollout(rollout)
+	}
+	canary, err := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Get(r.Params.Name+CanarySuffix, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			r.rollbackCanary(rollout)
+			rollout.transition(RolloutFailed, "canary deployment not found")
+			return saveRollout(rollout)
+		}
+		return err
+	}
+	if reason, err := r.rolloutHealth(canary); err != nil {
+		return err
+	} else if reason != "" {
+		return failCanary(r, rollout, "canary "+reason)
+	}
+	status := canary.Status
+	if canary.Generation > status.ObservedGeneration || status.UpdatedReplicas < *canary.Spec.Replicas || status.AvailableReplicas < *canary.Spec.Replicas {
+		return saveRollout(rollout)
+	}
+	if uid, err := r.getLatestReplica(string(canary.UID)); err == nil {
+		if podIP, err := r.getLatestReplicaPodIp(uid); err == nil {
+			rollout.PodIP = podIP
+		}
+	}
+	rollout.UpdatedReplicas = status.AvailableReplicas
+	if time.Now().Unix()-config.StepStart < config.Interval {
+		return saveRollout(rollout)
+	}
+	if err := r.analyseCanary(rollout); err != nil {
+		return failCanary(r, rollout, err.Error())
+	}
+	if rollout.CurrentStep < rollout.TotalSteps {
+		rollout.CurrentStep++
+		if err := r.startCanaryStep(rollout); err != nil {
+			return err
+		}
+		return saveRollout(rollout)
+	}
+	// 稳定版本的subset绑定旧的pod-template-hash，更新过程中会变为空，全量前先删除istio路由
+	if err := r.deleteCanaryRoute(rollout); err != nil {
+		return err
+	}
+	// 所有步骤分析通过，稳定版本应用patch并恢复副本数
+	patches := append([]common.PatchData{{Op: "replace", Path: "/spec/replicas", Value: config.StableReplicas}}, rollout.Patches...)
+	data, err := json.Marshal(patches)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Patch(r.Params.Name, types.JSONPatchType, data); err != nil {
+		log.Errorf("Deployment promote error:%s; Json:%s; Name:%s", err, string(data), r.Params.Name)
+		return err
+	}
+	config.Phase = CanaryPhasePromoting
+	rollout.transition(RolloutProgressing, "analysis passed, promoting canary")
+	return saveRollout(rollout)
+}
+
+func failCanary(r *ControllerResource, rollout *RolloutDB, message string) error {
+	if err := r.rollbackCanary(rollout); err != nil {
+		message = fmt.Sprintf("%s, rollback failed: %s", message, err)
+	} else {
+		message = message + ", canary rolled back"
+	}
+	rollout.transition(RolloutFailed, message)
+	notifyRollout(r, rollout, message)
+	return saveRollout(rollout)
+}
+
+// 执行分析查询，有一个不满足即失败
+func (r *ControllerResource) analyseCanary(rollout *RolloutDB) error {
+	if len(rollout.Canary.Analysis) == 0 {
+		return nil
+	}
+	clientSet, err := access.PrometheusClient()
+	if err != nil {
+		return err
+	}
+	prometheus := PrometheusResource{Params: r.Params, ClientSet: clientSet}
+	replacer := strings.NewReplacer("{{namespace}}", r.Params.Namespace, "{{name}}", r.Params.Name, "{{canary}}", r.Params.Name+CanarySuffix)
+	for _, analysis := range rollout.Canary.Analysis {
+		value, err := prometheus.QueryValue(replacer.Replace(analysis.Query))
+		if err != nil {
+			return fmt.Errorf("analysis %s error: %s", analysis.Name, err)
+		}
+		if (analysis.Min != nil && value < *analysis.Min) || (analysis.Max != nil && value > *analysis.Max) {
+			return fmt.Errorf("analysis %s failed at weight %d%%: value %v", analysis.Name, rollout.Canary.Weight, value)
+		}
+		log.Infof("Rollout %s analysis %s passed: value %v", rollout.Id, analysis.Name, value)
+	}
+	return nil
+}
+
+// 选择器和Pod模板标签匹配的Service
+func (r *ControllerResource) matchServices(deployment *v1.Deployment) ([]string, error) {
+	services, err := r.Params.ClientSet.CoreV1().Services(r.Params.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, service := range services.Items {
+		if len(service.Spec.Selector) == 0 || service.Spec.Type == corev1.ServiceTypeExternalName {
+			continue
+		}
+		if labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(deployment.Spec.Template.Labels)) {
+			names = append(names, service.Name)
+		}
+	}
+	return names, nil
+}
+
+// 当前版本ReplicaSet的pod-template-hash，istio模式下用来区分稳定版本的Pod
+func (r *ControllerResource) stableTemplateHash(deployment *v1.Deployment) (string, error) {
+	revisions, err := r.listDeploymentRevision()
+	if err != nil {
+		return "", err
+	}
+	for _, revision := range revisions {
+		if revision.Current {
+			rs, err := r.Params.ClientSet.AppsV1().ReplicaSets(r.Params.Namespace).Get(revision.Name, metav1.GetOptions{})
+			if err != nil {
+				return "", err
+			}
+			return rs.Labels[v1.DefaultDeploymentUniqueLabelKey], nil
+		}
+	}
+	return "", fmt.Errorf("current replicaset of deployment %s not found", deployment.Name)
+}
+
+func deploymentFailed(deployment *v1.Deployment) bool {
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == v1.DeploymentProgressing && condition.Status == corev1.ConditionFalse && condition.Reason == "ProgressDeadlineExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+func scaleDeployment(r *ControllerResource, name string, replicas int32) error {
+	data, err := json.Marshal([]common.PatchData{{Op: "replace", Path: "/spec/replicas", Value: replicas}})
+	if err != nil {
+		return err
+	}
+	if _, err := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Patch(name, types.JSONPatchType, data); err != nil {
+		log.Errorf("Deployment scale error:%s; Replicas:%d; Name:%s", err, replicas, name)
+		return err
+	}
+	return nil
+}
+
+// 手动暂停后恢复金丝雀，重新开始计算当前步骤的观察时间
+func (r *ControllerResource) resumeCanary(rollout *RolloutDB) (*RolloutDB, error) {
+	if rollout.State != RolloutPaused {
+		return nil, errors.New("canary release is analysed and promoted automatically")
+	}
+	if err := r.SetResume(); err != nil {
+		return nil, err
+	}
+	rollout.Canary.StepStart = time.Now().Unix()
+	rollout.transition(RolloutProgressing, fmt.Sprintf("step %d/%d resumed by %s", rollout.CurrentStep, rollout.TotalSteps, r.Params.User.Name))
+	if err := saveRollout(rollout); err != nil {
+		return nil, err
+	}
+	return rollout, nil
+}
@@ -0,0 +1,182 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"io"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/watch"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PodCapture          = common.ActionType("capture")
+	CapturePodPrefix    = "capture-pod-"
+	DebugSessionCapture = "capture"
+	// 抓包时长默认30秒最长5分钟，文件大小默认10M最大100M
+	CaptureDefaultDuration = 30
+	CaptureMaxDuration     = 300
+	CaptureDefaultSize     = 10 * 1024 * 1024
+	CaptureMaxSize         = 100 * 1024 * 1024
+)
+
+// 在节点上根据容器ID找到容器进程，进入其网络命名空间执行tcpdump，输出pcap到stdout
+// 通过cgroup查找进程，不依赖docker.sock，同样适用于containerd和CRI-O
+const captureScript = `pid=$(grep -l "$1" /proc/[0-9]*/cgroup 2>/dev/null | head -n 1 | cut -d / -f 3)
+if [ -z "$pid" ]; then echo "container process not found" >&2; exit 1; fi
+duration=$2; size=$3; shift 3
+timeout "$duration" nsenter -t "$pid" -n tcpdump -i any -U -s 0 -w - "$@" | head -c "$size"`
+
+type CaptureOptions struct {
+	Container string `json:"container"`
+	// BPF过滤表达式，例如 tcp port 80
+	Filter   string `json:"filter"`
+	Duration int64  `json:"duration"`
+	MaxBytes int64  `json:"maxBytes"`
+}
+
+// 在目标Pod的网络命名空间中抓包，pcap文件写入w
+func (r *PodResource) Capture(options *CaptureOptions, image string, w io.Writer) error {
+	if options.Duration <= 0 {
+		options.Duration = CaptureDefaultDuration
+	}
+	if options.Duration > CaptureMaxDuration {
+		options.Duration = CaptureMaxDuration
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = CaptureDefaultSize
+	}
+	if options.MaxBytes > CaptureMaxSize {
+		options.MaxBytes = CaptureMaxSize
+	}
+	if options.Container != "" {
+		r.Container = options.Container
+	}
+	target, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Get(r.Params.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if err := checkPrivilegedSessionPod(target); err != nil {
+		return err
+	}
+	if r.Container == "" {
+		r.Container = target.Spec.Containers[0].Name
+	}
+	podInfo, err := r.getContainerIDAndNode()
+	if err != nil {
+		return err
+	}
+	containerID := strings.Split(podInfo["ContainerID"], "//")
+	if len(containerID) != 2 {
+		return errors.New("get container id failed")
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Pod,
+		ActionType: PodCapture,
+		Resources:  r.Params,
+		Name:       r.Params.Name,
+		PostData:   options,
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return err
+	}
+	podSpec := r.getCapturePodSpec(podInfo, image, options.Duration)
+	markDebugSession(podSpec, DebugSessionCapture, r.Params.Name, r.Params.User, options.Duration+300)
+	pods := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace)
+	pod, err := pods.Create(podSpec)
+	if err != nil {
+		log.Errorf("Capture pod create error:%s; Name:%s", err, r.Params.Name)
+		return err
+	}
+	// 抓包结束后删除抓包Pod
+	defer func() {
+		if err := deleteDebugSessionPod(r.Params.ClientSet, pod); err != nil {
+			log.Errorf("Capture pod delete error:%s; Name:%s", err, pod.Name)
+		}
+	}()
+	watcher, err := pods.Watch(metav1.SingleObject(pod.ObjectMeta))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if _, err = watch.UntilWithoutRetry(ctx, watcher, PodRunning); err != nil {
+		return err
+	}
+	command := []string{"sh", "-c", captureScript, "sh", containerID[1], strconv.FormatInt(options.Duration, 10), strconv.FormatInt(options.MaxBytes, 10)}
+	if options.Filter != "" {
+		command = append(command, options.Filter)
+	}
+	capture := PodResource{Params: &handle.Resources{
+		Cluster:   r.Params.Cluster,
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+		ClientSet: r.Params.ClientSet,
+	}}
+	conn := &execConnection{}
+	stdout := &limitWriter{w: w, limit: options.MaxBytes, exceed: conn.Close}
+	stderr := &limitBuffer{limit: ExecOutputLimit}
+	err = capture.streamConnection(&v1.PodExecOptions{
+		Container: "capture",
+		Command:   command,
+		Stdout:    true,
+		Stderr:    true,
+	}, nil, stdout, stderr, conn)
+	// 已经输出了抓包数据时，timeout结束tcpdump属于正常结束
+	if err != nil && stdout.written == 0 {
+		log.Errorf("Pod capture error:%s; Stderr:%s; Name:%s", err, stderr.String(), r.Params.Name)
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// 抓包Pod固定在目标Pod所在的节点，使用宿主机PID命名空间查找容器进程
+func (r *PodResource) getCapturePodSpec(podInfo map[string]string, image string, duration int64) *v1.Pod {
+	t := false
+	privileged := true
+	gracePeriod := int64(0)
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        CapturePodPrefix + r.Params.Name + "-" + rand.String(5),
+			Namespace:   r.Params.Namespace,
+			Annotations: DisableIsitoInject, // 不开启istio注入
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion:         "v1",
+					Kind:               "Pod",
+					Name:               podInfo["Name"],
+					UID:                types.UID(podInfo["UID"]),
+					Controller:         &t,
+					BlockOwnerDeletion: &t,
+				},
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeName: podInfo["NodeName"], // 必须是要抓包的Pod所在的节点
+			HostPID:  true,
+			Containers: []v1.Container{
+				{
+					Name:            "capture",
+					Image:           image,
+					ImagePullPolicy: v1.PullIfNotPresent,
+					Command:         []string{"sleep", strconv.FormatInt(duration+300, 10)},
+					SecurityContext: &v1.SecurityContext{
+						Privileged: &privileged,
+					},
+				},
+			},
+			Tolerations:                   []v1.Toleration{{Operator: v1.TolerationOpExists}},
+			TerminationGracePeriodSeconds: &gracePeriod,
+			RestartPolicy:                 v1.RestartPolicyNever,
+		},
+	}
+}
@@ -11,15 +11,14 @@ import (
 	"github.com/open-kingfisher/king-utils/common/handle"
 	"github.com/open-kingfisher/king-utils/common/log"
 	"github.com/open-kingfisher/king-utils/kit"
+	"io"
 	"io/ioutil"
 	"k8s.io/api/apps/v1"
-	autoscalingv1 "k8s.io/api/autoscaling/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
-	"math"
 	"sort"
 	"strconv"
 	"strings"
@@ -32,6 +31,15 @@ type ControllerResource struct {
 	DaemonSetData   *v1.DaemonSet
 	StatefulSetData *v1.StatefulSet
 	TemplateData    *common.TemplateDB
+	LogOptions      *corev1.PodLogOptions
+	// 聚合日志时包含initContainers
+	LogInitContainers bool
+	// DaemonSet分步上线时节点分组使用的标签
+	NodeGroup string
+	// 被HPA管理时依然扩缩容
+	Force bool
+	// 另存为模板时把新版本设置为默认版本
+	DefaultTemplate bool
 }
 
 func (r *ControllerResource) Get() (interface{}, error) {
@@ -127,6 +135,51 @@ func (r *ControllerResource) ListPodByController() (*corev1.PodList, error) {
 	}
 }
 
+// 获取控制器的Pod标签选择器
+func (r *ControllerResource) getLabelSelector() (string, error) {
+	var selector *metav1.LabelSelector
+	switch r.Params.Controller {
+	case "deployment":
+		res, err := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Get(r.Params.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		selector = res.Spec.Selector
+	case "daemonset":
+		res, err := r.Params.ClientSet.AppsV1().DaemonSets(r.Params.Namespace).Get(r.Params.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		selector = res.Spec.Selector
+	case "statefulset":
+		res, err := r.Params.ClientSet.AppsV1().StatefulSets(r.Params.Namespace).Get(r.Params.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		selector = res.Spec.Selector
+	default:
+		return "", errors.New("controller kind doesn't exist")
+	}
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return "", err
+	}
+	return labelSelector.String(), nil
+}
+
+// 聚合输出控制器下所有Pod的日志，滚动更新过程中新Pod自动加入，删除的Pod自动移除
+func (r *ControllerResource) LogStream(ctx context.Context, w io.Writer) error {
+	selector, err := r.getLabelSelector()
+	if err != nil {
+		log.Errorf("%s get label selector error:%s; Name:%s", r.Params.Controller, err, r.Params.Name)
+		return err
+	}
+	if r.LogOptions == nil {
+		r.LogOptions = &corev1.PodLogOptions{}
+	}
+	return streamSelectorLog(ctx, r.Params.ClientSet, r.Params.Namespace, selector, r.LogOptions, r.LogInitContainers, w)
+}
+
 func (r *ControllerResource) GetChart() (interface{}, error) {
 	nodeDic := map[string]string{}
 	chartData := chart{}
@@ -634,6 +687,7 @@ func (r *ControllerResource) Create() (res interface{}, err error) {
 	}
 }
 
+// 同名模板已经存在时保存为新的版本
 func (r *ControllerResource) SaveAsTemplate() error {
 	switch r.Params.Controller {
 	case "deployment":
@@ -651,7 +705,7 @@ func (r *ControllerResource) SaveAsTemplate() error {
 			}
 			r.TemplateData.Spec = deployment
 			r.TemplateData.Kind = r.Params.Controller
-			if err := handle.CreateTemplate(r.TemplateData); err != nil {
+			if _, err := saveTemplateVersion(r.TemplateData, r.Params.User.Name, r.DefaultTemplate); err != nil {
 				log.Errorf("Template create error:%s; Json:%+v; Name:%s", err, r.TemplateData.Spec, r.TemplateData.Name)
 				return err
 			}
@@ -683,7 +737,7 @@ func (r *ControllerResource) SaveAsTemplate() error {
 			}
 			r.TemplateData.Spec = daemonSet
 			r.TemplateData.Kind = r.Params.Controller
-			if err := handle.CreateTemplate(r.TemplateData); err != nil {
+			if _, err := saveTemplateVersion(r.TemplateData, r.Params.User.Name, r.DefaultTemplate); err != nil {
 				log.Errorf("Template create error:%s; Json:%+v; Name:%s", err, r.TemplateData.Spec, r.TemplateData.Name)
 				return err
 			}
@@ -714,7 +768,7 @@ func (r *ControllerResource) SaveAsTemplate() error {
 			}
 			r.TemplateData.Spec = statefulSet
 			r.TemplateData.Kind = r.Params.Controller
-			if err := handle.CreateTemplate(r.TemplateData); err != nil {
+			if _, err := saveTemplateVersion(r.TemplateData, r.Params.User.Name, r.DefaultTemplate); err != nil {
 				log.Errorf("Template create error:%s; Json:%+v; Name:%s", err, r.TemplateData.Spec, r.TemplateData.Name)
 				return err
 			}
@@ -736,52 +790,6 @@ func (r *ControllerResource) SaveAsTemplate() error {
 	return nil
 }
 
-func (r *ControllerResource) Scale() (res interface{}, err error) {
-	scaleInt, err := strconv.Atoi(r.Params.Scale)
-	if err != nil {
-		return
-	}
-	scale := autoscalingv1.Scale{
-		Spec: autoscalingv1.ScaleSpec{
-			Replicas: int32(scaleInt),
-		},
-	}
-	switch r.Params.Controller {
-	case "deployment":
-		if res, err = r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).UpdateScale(r.Params.Name, &scale); err != nil {
-			log.Errorf("Deployment scale error:%s; Json:%+v; Name:%s", err, "", r.Params.Name)
-			return
-		}
-		auditLog := handle.AuditLog{
-			Kind:       common.Deployment,
-			ActionType: common.Scale,
-			Resources:  r.Params,
-			Name:       r.Params.Name,
-		}
-		if err = auditLog.InsertAuditLog(); err != nil {
-			return
-		}
-		return
-	case "statefulset":
-		if res, err = r.Params.ClientSet.AppsV1().StatefulSets(r.Params.Namespace).UpdateScale(r.Params.Name, &scale); err != nil {
-			log.Errorf("StatefulSet scale error:%s; Json:%+v; Name:%s", err, "", r.Params.Name)
-			return
-		}
-		auditLog := handle.AuditLog{
-			Kind:       common.StatefulSet,
-			ActionType: common.Scale,
-			Resources:  r.Params,
-			Name:       r.Params.Name,
-		}
-		if err = auditLog.InsertAuditLog(); err != nil {
-			return
-		}
-		return
-	default:
-		return nil, errors.New("controller kind doesn't exist")
-	}
-}
-
 func (r *ControllerResource) Watch() (res watch.Interface, err error) {
 	var labelSelector string
 	switch r.Params.Controller {
@@ -824,61 +832,81 @@ func (r *ControllerResource) Watch() (res watch.Interface, err error) {
 
 // 使用分组滚动更新后，剩下的手动分组进行滚动更新
 func (r *ControllerResource) PatchStepResume() (interface{}, error) {
-	// 检查滚动更新是否完成，已经完成直接返回
-	//if ok, err := r.checkRollingUpdateIsCompleted(); err != nil {
-	//	return nil, err
-	//} else {
-	//	if ok {
-	//		return nil, errors.New("rolling update is completed")
-	//	}
-	//}
-	var updatedReplicas int32
-	var replicas int32
-	if deployment, err := r.assertDeployment(); err != nil {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+	rollout, err := r.activeRollout()
+	if err != nil {
 		return nil, err
-	} else {
-		updatedReplicas = deployment.Status.UpdatedReplicas
-		replicas = *deployment.Spec.Replicas
-		if updatedReplicas == replicas {
-			podIP := make([]string, 0)
-			return map[string]interface{}{"replicas": replicas, "updatedReplicas": updatedReplicas, "podIP": podIP}, nil
-		}
 	}
-	ch := make(chan int)
-	// 开始监听Deployment事件
-	go func() {
-		if err := r.Resume(); err != nil {
-			log.Errorf("watch event error:%s; Json:%+v; Name:%s", err, "", r.Params.Name)
-		}
-		ch <- 1
-	}()
-	// paused为true，开始滚动更新
-	if err := r.SetResume(); err != nil {
+	if rollout == nil {
+		return nil, errors.New("no rollout in progress")
+	}
+	if rollout.State != RolloutPaused {
+		return nil, fmt.Errorf("rollout is %s, wait for the current step to complete", rollout.State)
+	}
+	if rollout.Strategy == RolloutCanary {
+		return r.resumeCanary(rollout)
+	}
+	// 手动暂停时当前步骤还未完成，继续当前步骤
+	if rollout.UpdatedReplicas >= rollout.target() {
+		rollout.CurrentStep++
+	}
+	// 开始下一步滚动更新
+	if err := r.resumeRollout(rollout); err != nil {
 		return nil, err
 	}
-	<-ch
-	// 同步等待已经更新的PodIP，超时2分钟
-	//ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	//defer cancel()
-	return r.WatchPodIP()
+	watchRolloutStep(r, rollout)
+	rollout.transition(RolloutProgressing, fmt.Sprintf("step %d/%d started by %s", rollout.CurrentStep, rollout.TotalSteps, r.Params.User.Name))
+	if err := saveRollout(rollout); err != nil {
+		return nil, err
+	}
+	return r.rolloutStatus(rollout)
 }
 
 // 使用分组滚动更新后，剩下的自动进行滚动更新
 func (r *ControllerResource) PatchAllResume() (interface{}, error) {
-	if err := r.SetResume(); err != nil {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+	rollout, err := r.activeRollout()
+	if err != nil {
 		return nil, err
 	}
-	// 同步等待已经更新的PodIP，超时2分钟
-	//ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	//defer cancel()
-	return r.WatchPodIP()
+	if rollout == nil {
+		return nil, errors.New("no rollout in progress")
+	}
+	if rollout.Strategy == RolloutCanary {
+		return r.resumeCanary(rollout)
+	}
+	rollout.Auto = true
+	rollout.CurrentStep = rollout.TotalSteps
+	if err := r.resumeRollout(rollout); err != nil {
+		return nil, err
+	}
+	rollout.transition(RolloutProgressing, "remaining steps resumed by "+r.Params.User.Name)
+	if err := saveRollout(rollout); err != nil {
+		return nil, err
+	}
+	return r.rolloutStatus(rollout)
 }
 
 // 手动暂停滚动更新
 func (r *ControllerResource) PatchPause() (interface{}, error) {
-	if err := r.SetPause(); err != nil {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+	if err := r.pauseRollout(); err != nil {
 		return nil, err
 	}
+	if rollout, err := r.activeRollout(); err != nil {
+		return nil, err
+	} else if rollout != nil && rollout.State != RolloutPaused && rollout.Strategy != RolloutBlueGreen {
+		rollout.transition(RolloutPaused, "paused by "+r.Params.User.Name)
+		if err := saveRollout(rollout); err != nil {
+			return nil, err
+		}
+	}
+	if r.Params.Controller != "deployment" {
+		return r.workloadPodIP()
+	}
 	var updatedReplicas int32
 	var replicas int32
 	if deployment, err := r.assertDeployment(); err != nil {
@@ -891,45 +919,53 @@ func (r *ControllerResource) PatchPause() (interface{}, error) {
 	return map[string]interface{}{"replicas": replicas, "updatedReplicas": updatedReplicas, "podIP": podIP}, nil
 }
 
-// 分步上线的首次上线，修改最大不可达，修改镜像地址
+// 分步上线的首次上线，Deployment修改最大不可达，StatefulSet和DaemonSet修改更新策略，同时修改镜像地址
+// 上线过程记录在数据库中，由RolloutReconciler跟踪每一步并在步骤边界暂停
 func (r *ControllerResource) PatchImage() (interface{}, error) {
 	// 校验step参数是否正确
 	if err := r.verifyStep(); err != nil {
 		return nil, err
 	}
-	// 检查滚动更新是否完成，没有完成直接返回
-	//if ok, err := r.checkRollingUpdateIsCompleted(); err != nil {
-	//	return err
-	//} else {
-	//	if !ok {
-	//		return errors.New("rolling update is not complete")
-	//	}
-	//}
-	// 获取更新镜像的patch json
-	patchImage := r.Params.PatchData.Patches
-	// 不论状态是否暂停，设置设置成恢复
-	if err := r.SetResume(); err != nil {
+	if r.Params.Controller != "deployment" {
+		rolloutLock.Lock()
+		defer rolloutLock.Unlock()
+		return r.startWorkloadRollout()
+	}
+	deployment, err := r.assertDeployment()
+	if err != nil {
 		return nil, err
 	}
-	go func() {
-		if err := r.Resume(); err != nil {
-			// 一旦发生错误，直接停止滚动更新
-			if err := r.SetPause(); err != nil {
-				log.Errorf("patch pause true error:%s; Json:%+v; Name:%s", err, "", r.Params.Name)
-			}
-			log.Errorf("patch image error:%s; Json:%+v; Name:%s", err, "", r.Params.Name)
-		}
-	}()
-	r.Params.PatchData.Patches = patchImage
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
 	// 更新镜像的时候修改maxUnavailable值为步长
 	r.SetStrategy()
+	rollout, err := r.startRollout(*deployment.Spec.Replicas, deploymentRevision(deployment), r.Params.PatchData.Patches)
+	if err != nil {
+		return nil, err
+	}
+	// 不论状态是否暂停，设置成恢复，和镜像一起更新
+	r.Params.PatchData.Patches = append([]common.PatchData{{Op: "add", Path: "/spec/paused", Value: false}}, rollout.Patches...)
 	if _, err := r.Patch(); err != nil {
+		rollout.transition(RolloutFailed, err.Error())
+		saveRollout(rollout)
 		return nil, err
 	}
-	// 同步等待已经更新的PodIP，超时2分钟
-	//ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
-	//defer cancel()
-	return r.WatchPodIP()
+	watchRolloutStep(r, rollout)
+	rollout.transition(RolloutProgressing, fmt.Sprintf("step %d/%d started by %s", rollout.CurrentStep, rollout.TotalSteps, r.Params.User.Name))
+	if err := saveRollout(rollout); err != nil {
+		return nil, err
+	}
+	return r.rolloutStatus(rollout)
+}
+
+// 返回更新的副本数以及PodIP，同时带上分步上线记录
+func (r *ControllerResource) rolloutStatus(rollout *RolloutDB) (interface{}, error) {
+	res, err := r.WatchPodIP()
+	if err != nil {
+		return nil, err
+	}
+	res["rollout"] = rollout
+	return res, nil
 }
 
 func (r *ControllerResource) SetStrategy() {
@@ -980,114 +1016,6 @@ func (r *ControllerResource) SetResume() error {
 	}
 }
 
-func (r *ControllerResource) Resume() error {
-	var maxUnavailable int32
-	var maxSurge int32
-	var lastCompletedUpdatedReplicas int32
-	var replicas int32
-	// 获取event
-	event, err := r.Watch()
-	if err != nil {
-		log.Errorf("Deployment watch error:%s; Json:%+v; Name:%s", err, "", r.Params.Name)
-		return err
-	}
-	// 获取deployment
-	if deployment, err := r.assertDeployment(); err == nil {
-		// 获取定义的副本数
-		replicas = *deployment.Spec.Replicas
-		// 获取最大不可达数 Type为0的时候为整形，为1的时候为字符串类型
-		if deployment.Spec.Strategy.RollingUpdate.MaxUnavailable.Type == 0 {
-			maxUnavailable = int32(deployment.Spec.Strategy.RollingUpdate.MaxUnavailable.IntValue())
-		} else if deployment.Spec.Strategy.RollingUpdate.MaxUnavailable.Type == 1 {
-			// 百分比的字符串转换成整形
-			v, err := r.percentValueToIntValue(deployment.Spec.Strategy.RollingUpdate.MaxUnavailable.String())
-			if err != nil {
-				log.Errorf("max unavailable percent to int error:%s; Json:%+v; Name:%s", err, "", r.Params.Name)
-				return err
-			} else {
-				// 除不尽的处理
-				roundUp := false
-				if roundUp {
-					// 除不尽的情况直接返回不小于结果的最小整数，例： 35 * 10 / 100 maxUnavailable = 4
-					maxUnavailable = int32(math.Ceil(float64(v) * (float64(replicas)) / 100))
-				} else {
-					// 除不尽的情况直接返回不大于结果的最大整数，例： 35 * 10 / 100 maxUnavailable = 3
-					maxUnavailable = int32(math.Floor(float64(v) * (float64(replicas)) / 100))
-				}
-			}
-		}
-		// 获取最大激增数
-		if deployment.Spec.Strategy.RollingUpdate.MaxSurge.Type == 0 {
-			maxSurge = int32(deployment.Spec.Strategy.RollingUpdate.MaxSurge.IntValue())
-		} else if deployment.Spec.Strategy.RollingUpdate.MaxSurge.Type == 1 {
-			v, err := r.percentValueToIntValue(deployment.Spec.Strategy.RollingUpdate.MaxSurge.String())
-			if err != nil {
-				log.Errorf("max surge percent to int error:%s; Json:%+v; Name:%s", err, "", r.Params.Name)
-				return err
-			} else {
-				// 除不尽的处理
-				roundUp := false
-				if roundUp {
-					// 除不尽的情况直接返回不小于结果的最小整数，例： 35 * 10 / 100 maxUnavailable = 4
-					maxSurge = int32(math.Ceil(float64(v) * (float64(replicas)) / 100))
-				} else {
-					// 除不尽的情况直接返回不大于结果的最大整数，例： 35 * 10 / 100 maxUnavailable = 3
-					maxSurge = int32(math.Floor(float64(v) * (float64(replicas)) / 100))
-				}
-			}
-		}
-		// 获取状态里面的UpdatedReplicas数值，记为上一次已经完成的数量
-		lastCompletedUpdatedReplicas = deployment.Status.UpdatedReplicas
-	} else {
-		return err
-	}
-	// 副本数和上一次已经完成的数量相等说明是首次进行暂停更新
-	if lastCompletedUpdatedReplicas == replicas {
-		lastCompletedUpdatedReplicas = 0
-	}
-	// 循环event的channel以便获取Department的更新
-	for v := range event.ResultChan() {
-		if d, ok := v.Object.(*v1.Deployment); ok {
-			log.Infof("Deployment status: %+v\n", d.Status)
-			updatedReplicas := d.Status.UpdatedReplicas
-			log.Infof("lastCompletedUpdatedReplicas: %d updatedReplicas: %d maxUnavailable: %d maxSurge: %d", lastCompletedUpdatedReplicas, updatedReplicas, maxUnavailable, maxSurge)
-			// 传递过来的步长数等于最大不可达数，数量达到这个范围进行Pause操作
-			// lastCompletedUpdatedReplicas > updatedReplicas && lastCompletedUpdatedReplicas <= maxUnavailable+updatedReplicas+maxSurge
-			if updatedReplicas == lastCompletedUpdatedReplicas+maxUnavailable+maxSurge+1 {
-				// 进行暂停操作
-				if err := r.SetPause(); err != nil {
-					log.Errorf("Deployment patch pause error:%s; Json:%+v; Name:%s", err, "", r.Params.Name)
-					return err
-				} else {
-					event.Stop()
-					return nil
-				}
-			}
-			// 说明已经更新完成，/spec/paused 设置成false
-			// maxUnavailable+updatedReplicas+maxSurge >= replicas
-			if d.Status.Replicas == replicas &&
-				d.Status.UpdatedReplicas == replicas &&
-				d.Status.ReadyReplicas == replicas &&
-				d.Status.AvailableReplicas == replicas &&
-				d.Status.UnavailableReplicas == 0 &&
-				lastCompletedUpdatedReplicas != 0 {
-				if err := r.SetResume(); err != nil {
-					log.Errorf("Deployment patch resume error:%s; Json:%+v; Name:%s", err, "", r.Params.Name)
-					return err
-				}
-				log.Info("resume: ", true)
-				// 停止次channel
-				event.Stop()
-				return nil
-			}
-		} else {
-			log.Errorf("Deployment assert error:%s; Json:%+v; Name:%s", err, "", r.Params.Name)
-			return err
-		}
-	}
-	return nil
-}
-
 func (r *ControllerResource) GenerateCreateData(c *gin.Context) (err error) {
 	var kindType string
 	var jsonByte []byte
@@ -1239,9 +1167,18 @@ func (r *ControllerResource) percentValueToIntValue(percent string) (int, error)
 
 func (r *ControllerResource) verifyStep() error {
 	var replicas int32
-	if deployment, err := r.assertDeployment(); err == nil {
-		// 获取定义的副本数
-		replicas = *deployment.Spec.Replicas
+	if object, err := r.Get(); err == nil {
+		// 获取定义的副本数，DaemonSet为需要调度的节点数
+		switch o := object.(type) {
+		case *v1.Deployment:
+			replicas = *o.Spec.Replicas
+		case *v1.StatefulSet:
+			replicas = *o.Spec.Replicas
+		case *v1.DaemonSet:
+			replicas = o.Status.DesiredNumberScheduled
+		default:
+			return errors.New("controller kind doesn't support stepped rollout")
+		}
 	} else {
 		return err
 	}
@@ -1276,6 +1213,9 @@ func (r *ControllerResource) verifyStep() error {
 }
 
 func (r *ControllerResource) WatchPodIP() (map[string]interface{}, error) {
+	if r.Params.Controller != "deployment" {
+		return r.workloadPodIP()
+	}
 	var updatedReplicas int32
 	var replicas int32
 	var unavailableReplicas int32
@@ -0,0 +1,317 @@
+package resource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-k8s/util"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/diff"
+	"sort"
+	"strconv"
+)
+
+const (
+	ControllerHistory     = common.ActionType("history")
+	ControllerHistoryDiff = common.ActionType("history_diff")
+	ControllerRollback    = common.ActionType("rollback")
+	// Deployment控制器写在ReplicaSet上的版本号以及kubectl记录的变更原因
+	DeploymentRevision = "deployment.kubernetes.io/revision"
+	ChangeCause        = "kubernetes.io/change-cause"
+)
+
+type ControllerRevision struct {
+	Revision    int64                   `json:"revision"`
+	Name        string                  `json:"name"`
+	Images      []string                `json:"images"`
+	ChangeCause string                  `json:"changeCause"`
+	Create      int64                   `json:"create"`
+	Current     bool                    `json:"current"`
+	Template    *corev1.PodTemplateSpec `json:"template,omitempty"`
+}
+
+type ControllerRevisionDiff struct {
+	From *ControllerRevision `json:"from"`
+	To   *ControllerRevision `json:"to"`
+	Diff string              `json:"diff"`
+}
+
+// 版本历史，Deployment使用ReplicaSet，StatefulSet和DaemonSet使用ControllerRevision，按版本号倒序
+func (r *ControllerResource) History() ([]*ControllerRevision, error) {
+	revisions, err := r.listRevision()
+	if err != nil {
+		return nil, err
+	}
+	for _, revision := range revisions {
+		revision.Template = nil
+	}
+	return revisions, nil
+}
+
+// 比较两个版本的Pod模板，to为0时和当前版本比较
+func (r *ControllerResource) HistoryDiff(from, to int64) (*ControllerRevisionDiff, error) {
+	revisions, err := r.listRevision()
+	if err != nil {
+		return nil, err
+	}
+	fromRevision := findRevision(revisions, from)
+	if fromRevision == nil {
+		return nil, fmt.Errorf("revision %d not found", from)
+	}
+	toRevision := findRevision(revisions, to)
+	if toRevision == nil {
+		return nil, fmt.Errorf("revision %d not found", to)
+	}
+	return &ControllerRevisionDiff{
+		From: fromRevision,
+		To:   toRevision,
+		Diff: diff.ObjectReflectDiff(fromRevision.Template, toRevision.Template),
+	}, nil
+}
+
+// 回滚到指定版本，revision为0时回滚到上一个版本
+func (r *ControllerResource) Rollback(revision int64) (*ControllerRevision, error) {
+	revisions, err := r.listRevision()
+	if err != nil {
+		return nil, err
+	}
+	var target *ControllerRevision
+	if revision == 0 {
+		// 当前版本之后的第一个即为上一个版本
+		for i, v := range revisions {
+			if v.Current && i+1 < len(revisions) {
+				target = revisions[i+1]
+				break
+			}
+		}
+		if target == nil {
+			return nil, errors.New("no previous revision to rollback to")
+		}
+	} else if target = findRevision(revisions, revision); target == nil {
+		return nil, fmt.Errorf("revision %d not found", revision)
+	}
+	if target.Current {
+		return nil, fmt.Errorf("already at revision %d", target.Revision)
+	}
+	var kind string
+	switch r.Params.Controller {
+	case "deployment":
+		kind = common.Deployment
+		err = r.rollbackDeployment(target)
+	case "daemonset":
+		kind = common.DaemonSet
+		err = r.rollbackControllerRevision(target)
+	case "statefulset":
+		kind = common.StatefulSet
+		err = r.rollbackControllerRevision(target)
+	default:
+		return nil, errors.New("controller kind doesn't exist")
+	}
+	if err != nil {
+		log.Errorf("%s rollback error:%s; Revision:%d; Name:%s", kind, err, target.Revision, r.Params.Name)
+		return nil, err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       kind,
+		ActionType: ControllerRollback,
+		Resources:  r.Params,
+		Name:       r.Params.Name,
+		PostData:   map[string]interface{}{"revision": target.Revision, "images": target.Images},
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return nil, err
+	}
+	target.Template = nil
+	return target, nil
+}
+
+func (r *ControllerResource) listRevision() ([]*ControllerRevision, error) {
+	var revisions []*ControllerRevision
+	var err error
+	switch r.Params.Controller {
+	case "deployment":
+		revisions, err = r.listDeploymentRevision()
+	case "daemonset", "statefulset":
+		revisions, err = r.listControllerRevision()
+	default:
+		return nil, errors.New("controller kind doesn't exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision > revisions[j].Revision
+	})
+	return revisions, nil
+}
+
+// 通过GetReplicaSetForController相同的方式，根据Deployment的uid找到所有副本集
+func (r *ControllerResource) listDeploymentRevision() ([]*ControllerRevision, error) {
+	deployment, err := r.assertDeployment()
+	if err != nil {
+		return nil, err
+	}
+	params := *r.Params
+	params.Uid = string(deployment.UID)
+	replicaSet := ReplicaSetResource{Params: &params}
+	replicaSetList, err := replicaSet.List()
+	if err != nil {
+		return nil, err
+	}
+	revisions := make([]*ControllerRevision, 0, len(replicaSetList.Items))
+	for _, rs := range replicaSetList.Items {
+		revision, err := strconv.ParseInt(rs.Annotations[DeploymentRevision], 10, 64)
+		if err != nil {
+			continue
+		}
+		template := rs.Spec.Template.DeepCopy()
+		// pod-template-hash由Deployment控制器添加，比较和回滚时需要去掉
+		delete(template.Labels, v1.DefaultDeploymentUniqueLabelKey)
+		revisions = append(revisions, &ControllerRevision{
+			Revision:    revision,
+			Name:        rs.Name,
+			Images:      templateImages(template),
+			ChangeCause: rs.Annotations[ChangeCause],
+			Create:      rs.CreationTimestamp.Unix(),
+			Current:     rs.Annotations[DeploymentRevision] == deployment.Annotations[DeploymentRevision],
+			Template:    template,
+		})
+	}
+	return revisions, nil
+}
+
+func (r *ControllerResource) listControllerRevision() ([]*ControllerRevision, error) {
+	object, err := r.Get()
+	if err != nil {
+		return nil, err
+	}
+	var uid types.UID
+	var selector *metav1.LabelSelector
+	var currentRevision string
+	switch o := object.(type) {
+	case *v1.DaemonSet:
+		uid, selector = o.UID, o.Spec.Selector
+	case *v1.StatefulSet:
+		uid, selector, currentRevision = o.UID, o.Spec.Selector, o.Status.UpdateRevision
+	}
+	if selector == nil {
+		return nil, errors.New("controller selector is empty")
+	}
+	list, err := r.Params.ClientSet.AppsV1().ControllerRevisions(r.Params.Namespace).List(metav1.ListOptions{LabelSelector: util.GenerateLabelSelector(selector.MatchLabels)})
+	if err != nil {
+		return nil, err
+	}
+	revisions := make([]*ControllerRevision, 0, len(list.Items))
+	var latest *ControllerRevision
+	for _, history := range list.Items {
+		if !metav1.IsControlledBy(&history, &metav1.ObjectMeta{UID: uid}) {
+			continue
+		}
+		template, err := revisionTemplate(history.Data.Raw)
+		if err != nil {
+			log.Errorf("ControllerRevision decode error:%s; Name:%s", err, history.Name)
+			continue
+		}
+		revision := &ControllerRevision{
+			Revision:    history.Revision,
+			Name:        history.Name,
+			Images:      templateImages(template),
+			ChangeCause: history.Annotations[ChangeCause],
+			Create:      history.CreationTimestamp.Unix(),
+			Current:     history.Name == currentRevision,
+			Template:    template,
+		}
+		if latest == nil || revision.Revision > latest.Revision {
+			latest = revision
+		}
+		revisions = append(revisions, revision)
+	}
+	// DaemonSet的状态中没有版本名称，最大的版本号即为当前版本
+	if currentRevision == "" && latest != nil {
+		latest.Current = true
+	}
+	return revisions, nil
+}
+
+// 和kubectl rollout undo相同，使用版本中的Pod模板替换当前模板，并带上变更原因
+func (r *ControllerResource) rollbackDeployment(target *ControllerRevision) error {
+	deployment, err := r.assertDeployment()
+	if err != nil {
+		return err
+	}
+	if deployment.Spec.Paused {
+		return errors.New("cannot rollback a paused deployment, resume it first")
+	}
+	if apiequality.Semantic.DeepEqual(&deployment.Spec.Template, target.Template) {
+		return fmt.Errorf("revision %d is the same as the current template", target.Revision)
+	}
+	annotations := make(map[string]string)
+	for k, v := range deployment.Annotations {
+		annotations[k] = v
+	}
+	if target.ChangeCause != "" {
+		annotations[ChangeCause] = target.ChangeCause
+	} else {
+		delete(annotations, ChangeCause)
+	}
+	patch, err := json.Marshal([]common.PatchData{
+		{Op: "replace", Path: "/spec/template", Value: target.Template},
+		{Op: "replace", Path: "/metadata/annotations", Value: annotations},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Patch(r.Params.Name, types.JSONPatchType, patch)
+	return err
+}
+
+// ControllerRevision中保存的是可以直接应用的strategic merge patch
+func (r *ControllerResource) rollbackControllerRevision(target *ControllerRevision) error {
+	history, err := r.Params.ClientSet.AppsV1().ControllerRevisions(r.Params.Namespace).Get(target.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	switch r.Params.Controller {
+	case "daemonset":
+		_, err = r.Params.ClientSet.AppsV1().DaemonSets(r.Params.Namespace).Patch(r.Params.Name, types.StrategicMergePatchType, history.Data.Raw)
+	case "statefulset":
+		_, err = r.Params.ClientSet.AppsV1().StatefulSets(r.Params.Namespace).Patch(r.Params.Name, types.StrategicMergePatchType, history.Data.Raw)
+	}
+	return err
+}
+
+func revisionTemplate(data []byte) (*corev1.PodTemplateSpec, error) {
+	var patch struct {
+		Spec struct {
+			Template corev1.PodTemplateSpec `json:"template"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	return &patch.Spec.Template, nil
+}
+
+func findRevision(revisions []*ControllerRevision, revision int64) *ControllerRevision {
+	for _, v := range revisions {
+		if (revision == 0 && v.Current) || (revision != 0 && v.Revision == revision) {
+			return v
+		}
+	}
+	return nil
+}
+
+func templateImages(template *corev1.PodTemplateSpec) []string {
+	images := make([]string, 0, len(template.Spec.Containers))
+	for _, c := range template.Spec.Containers {
+		images = append(images, c.Image)
+	}
+	return images
+}
@@ -0,0 +1,170 @@
+package resource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"strconv"
+	"strings"
+)
+
+const (
+	ScaleRevert = common.ActionType("scale_revert")
+	// 扩缩容前的副本数，用于一键恢复
+	PreviousReplicas = "kingfisher.io/previous-replicas"
+)
+
+type ScaleResult struct {
+	Replicas         int32    `json:"replicas"`
+	PreviousReplicas int32    `json:"previousReplicas"`
+	HPA              []string `json:"hpa,omitempty"`
+	Warning          string   `json:"warning,omitempty"`
+}
+
+// 通过scale子资源修改副本数，被HPA管理时需要force参数
+func (r *ControllerResource) Scale() (*ScaleResult, error) {
+	replicas, err := strconv.Atoi(r.Params.Scale)
+	if err != nil {
+		return nil, errors.New("invalid scale parameter: " + err.Error())
+	}
+	if replicas < 0 {
+		return nil, errors.New("replicas less then 0")
+	}
+	return r.scaleTo(int32(replicas), common.Scale)
+}
+
+// 恢复到上一次扩缩容前的副本数
+func (r *ControllerResource) RevertScale() (*ScaleResult, error) {
+	object, err := r.Get()
+	if err != nil {
+		return nil, err
+	}
+	var annotations map[string]string
+	switch o := object.(type) {
+	case *v1.Deployment:
+		annotations = o.Annotations
+	case *v1.StatefulSet:
+		annotations = o.Annotations
+	default:
+		return nil, errors.New("controller kind doesn't support scale")
+	}
+	previous, ok := annotations[PreviousReplicas]
+	if !ok {
+		return nil, errors.New("no previous replicas recorded")
+	}
+	replicas, err := strconv.Atoi(previous)
+	if err != nil {
+		return nil, err
+	}
+	return r.scaleTo(int32(replicas), ScaleRevert)
+}
+
+func (r *ControllerResource) scaleTo(replicas int32, action common.ActionType) (*ScaleResult, error) {
+	result := &ScaleResult{Replicas: replicas}
+	hpa, err := r.scaleTargetHPA()
+	if err != nil {
+		return nil, err
+	}
+	if len(hpa) > 0 {
+		result.HPA = hpa
+		if !r.Force {
+			return nil, fmt.Errorf("%s is managed by HPA %s, replicas will be overridden, use force to scale anyway", r.Params.Name, strings.Join(hpa, ","))
+		}
+		result.Warning = fmt.Sprintf("managed by HPA %s, replicas may be overridden", strings.Join(hpa, ","))
+	}
+	var kind string
+	switch r.Params.Controller {
+	case "deployment":
+		kind = common.Deployment
+	case "statefulset":
+		kind = common.StatefulSet
+	default:
+		return nil, errors.New("controller kind doesn't support scale")
+	}
+	// 使用scale子资源当前的resourceVersion更新，冲突时重新获取
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var scale *autoscalingv1.Scale
+		var err error
+		if kind == common.Deployment {
+			scale, err = r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).GetScale(r.Params.Name, metav1.GetOptions{})
+		} else {
+			scale, err = r.Params.ClientSet.AppsV1().StatefulSets(r.Params.Namespace).GetScale(r.Params.Name, metav1.GetOptions{})
+		}
+		if err != nil {
+			return err
+		}
+		result.PreviousReplicas = scale.Spec.Replicas
+		scale.Spec.Replicas = replicas
+		if kind == common.Deployment {
+			_, err = r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).UpdateScale(r.Params.Name, scale)
+		} else {
+			_, err = r.Params.ClientSet.AppsV1().StatefulSets(r.Params.Namespace).UpdateScale(r.Params.Name, scale)
+		}
+		return err
+	})
+	if err != nil {
+		log.Errorf("%s scale error:%s; Replicas:%d; Name:%s", kind, err, replicas, r.Params.Name)
+		return nil, err
+	}
+	// 副本数没有变化时保留原来的记录
+	if result.PreviousReplicas != replicas {
+		if err := r.recordPreviousReplicas(result.PreviousReplicas); err != nil {
+			log.Errorf("%s previous replicas record error:%s; Name:%s", kind, err, r.Params.Name)
+		}
+	}
+	auditLog := handle.AuditLog{
+		Kind:       kind,
+		ActionType: action,
+		Resources:  r.Params,
+		Name:       r.Params.Name,
+		PostData:   result,
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *ControllerResource) recordPreviousReplicas(replicas int32) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{PreviousReplicas: strconv.Itoa(int(replicas))},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	switch r.Params.Controller {
+	case "deployment":
+		_, err = r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Patch(r.Params.Name, types.MergePatchType, data)
+	case "statefulset":
+		_, err = r.Params.ClientSet.AppsV1().StatefulSets(r.Params.Namespace).Patch(r.Params.Name, types.MergePatchType, data)
+	}
+	return err
+}
+
+// 以此控制器为目标的HPA名称
+func (r *ControllerResource) scaleTargetHPA() ([]string, error) {
+	params := *r.Params
+	params.Kind = r.Params.Controller
+	params.KindName = r.Params.Name
+	hpa := HPAResource{Params: &params}
+	list, err := hpa.List()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(list.Items))
+	for _, v := range list.Items {
+		names = append(names, v.Name)
+	}
+	return names, nil
+}
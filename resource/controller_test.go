@@ -6,11 +6,17 @@ import (
 	"github.com/open-kingfisher/king-utils/common/access"
 	"github.com/open-kingfisher/king-utils/common/handle"
 	"k8s.io/api/apps/v1"
+	"os"
 	"testing"
 )
 
+// 需要可以访问的集群，通过KINGFISHER_TEST_CLUSTER指定集群Id
 func TestControllerResource_Watch(t *testing.T) {
-	clientSet, err := access.Access("c_9941048464f")
+	cluster := os.Getenv("KINGFISHER_TEST_CLUSTER")
+	if cluster == "" {
+		t.Skip("KINGFISHER_TEST_CLUSTER is not set")
+	}
+	clientSet, err := access.Access(cluster)
 	//patch := common.PatchData{
 	//	Op:"add",
 	//	Path: "/spec/paused",
@@ -20,7 +26,7 @@ func TestControllerResource_Watch(t *testing.T) {
 		Params: &handle.Resources{
 			Name:       "nginx01",
 			Namespace:  "default",
-			Cluster:    "c_9941048464f",
+			Cluster:    cluster,
 			Controller: "deployment",
 			ClientSet:  clientSet,
 			PatchData: &common.PatchJson{
@@ -47,7 +53,6 @@ func TestControllerResource_Watch(t *testing.T) {
 	var replicas int32
 	de, ok := deployment.(*v1.Deployment)
 	if ok {
-		a
 		maxUnavailable = int32(de.Spec.Strategy.RollingUpdate.MaxUnavailable.IntValue())
 		updatedReplicas = de.Status.UpdatedReplicas
 		replicas = *de.Spec.Replicas
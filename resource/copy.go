@@ -0,0 +1,191 @@
+package resource
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"io"
+	"k8s.io/api/core/v1"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PodCopyFrom = common.ActionType("copy_from")
+	PodCopyTo   = common.ActionType("copy_to")
+	// 下载最大1G，上传最大100M
+	CopyFromLimit = 1024 * 1024 * 1024
+	CopyToLimit   = 100 * 1024 * 1024
+)
+
+// 与kubectl cp相同，通过容器中的tar命令打包下载文件或者目录，输出为tar流
+func (r *PodResource) CopyFrom(w io.Writer) error {
+	src, err := cleanContainerPath(r.FilePath)
+	if err != nil {
+		return err
+	}
+	if err := r.checkTargetPod(); err != nil {
+		return err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Pod,
+		ActionType: PodCopyFrom,
+		Resources:  r.Params,
+		Name:       r.Params.Name,
+		PostData:   map[string]string{"container": r.Container, "path": src},
+	}
+	// 开始输出前检查大小，超过限制时还可以返回错误信息
+	if size, err := r.containerPathSize(src); err != nil {
+		log.Errorf("Pod path size error:%s; Path:%s; Name:%s", err, src, r.Params.Name)
+	} else if size > CopyFromLimit {
+		return errCopyFromTooLarge
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return err
+	}
+	// 输出超过限制时断开连接，终止容器中的tar
+	conn := &execConnection{}
+	stdout := &limitWriter{w: w, limit: CopyFromLimit, exceed: conn.Close}
+	stderr := &limitBuffer{limit: ExecOutputLimit}
+	err = r.streamConnection(&v1.PodExecOptions{
+		Container: r.Container,
+		Command:   []string{"tar", "cf", "-", "-C", path.Dir(src), path.Base(src)},
+		Stdout:    true,
+		Stderr:    true,
+	}, nil, stdout, stderr, conn)
+	if stdout.exceeded {
+		return errCopyFromTooLarge
+	}
+	if err != nil {
+		log.Errorf("Pod copy from error:%s; Stderr:%s; Path:%s; Name:%s", err, stderr.String(), src, r.Params.Name)
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// 上传文件到容器的指定目录，容器中需要有tar命令
+func (r *PodResource) CopyTo(name string, size int64, src io.Reader) error {
+	dest, err := cleanContainerPath(r.FilePath)
+	if err != nil {
+		return err
+	}
+	name = path.Base(name)
+	if name == "." || name == "/" || name == ".." {
+		return errors.New("invalid file name")
+	}
+	if size > CopyToLimit {
+		return fmt.Errorf("file size exceeds the limit of %d bytes", CopyToLimit)
+	}
+	if err := r.checkTargetPod(); err != nil {
+		return err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Pod,
+		ActionType: PodCopyTo,
+		Resources:  r.Params,
+		Name:       r.Params.Name,
+		PostData:   map[string]interface{}{"container": r.Container, "path": dest, "file": name, "size": size},
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return err
+	}
+	// 将上传的文件打包成tar流作为容器中tar命令的输入
+	reader, writer := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(writer)
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    size,
+			ModTime: time.Now(),
+		})
+		if err == nil {
+			_, err = io.CopyN(tw, src, size)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	stderr := &limitBuffer{limit: ExecOutputLimit}
+	err = r.stream(&v1.PodExecOptions{
+		Container: r.Container,
+		Command:   []string{"tar", "xmf", "-", "-C", dest},
+		Stdin:     true,
+		Stdout:    true,
+		Stderr:    true,
+	}, reader, &limitBuffer{limit: ExecOutputLimit}, stderr)
+	reader.Close()
+	if err != nil {
+		log.Errorf("Pod copy to error:%s; Stderr:%s; Path:%s; Name:%s", err, stderr.String(), dest, r.Params.Name)
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// 容器中的路径必须是绝对路径
+func cleanContainerPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return "", errors.New("path must be an absolute path")
+	}
+	return path.Clean(p), nil
+}
+
+// 通过du获取文件或者目录的大小，容器中没有du命令时返回错误
+func (r *PodResource) containerPathSize(p string) (int64, error) {
+	stdout := &limitBuffer{limit: ExecOutputLimit}
+	stderr := &limitBuffer{limit: ExecOutputLimit}
+	err := r.stream(&v1.PodExecOptions{
+		Container: r.Container,
+		Command:   []string{"du", "-sk", p},
+		Stdout:    true,
+		Stderr:    true,
+	}, nil, stdout, stderr)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	fields := strings.Fields(stdout.String())
+	if len(fields) == 0 {
+		return 0, errors.New("unexpected du output")
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * 1024, nil
+}
+
+var (
+	errCopyFromTooLarge    = fmt.Errorf("file size exceeds the limit of %d bytes", CopyFromLimit)
+	errOutputLimitExceeded = errors.New("output exceeds the limit")
+)
+
+// 超过限制后返回错误并调用exceed，不再继续写入
+type limitWriter struct {
+	w        io.Writer
+	limit    int64
+	written  int64
+	exceeded bool
+	exceed   func()
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, errOutputLimitExceeded
+	}
+	if l.written+int64(len(p)) > l.limit {
+		l.exceeded = true
+		if l.exceed != nil {
+			l.exceed()
+		}
+		return 0, errOutputLimitExceeded
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,178 @@
+package resource
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/version"
+	watchType "k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/watch"
+	"time"
+)
+
+const (
+	// auto（默认）优先使用临时容器，集群不支持时使用docker.sock方式；ephemeral只使用临时容器；docker只使用docker.sock方式
+	DebugModeAuto        = "auto"
+	DebugModeEphemeral   = "ephemeral"
+	DebugModeDocker      = "docker"
+	EphemeralDebugPrefix = "debugger-"
+)
+
+var (
+	// 1.16开始支持临时容器，1.22开始ephemeralcontainers子资源使用Pod对象
+	ephemeralContainersVersion = version.MustParseGeneric("1.16")
+	ephemeralContainersPodAPI  = version.MustParseGeneric("1.22")
+	errEphemeralUnsupported    = errors.New("ephemeral containers are not supported by the cluster")
+)
+
+// 临时容器调试的结果，通过终端连接Pod中的临时容器
+type EphemeralDebug struct {
+	Mode      string  `json:"mode"`
+	Pod       *v1.Pod `json:"pod"`
+	Container string  `json:"container"`
+}
+
+// 在Pod中添加临时容器，共享目标容器的进程命名空间，不依赖节点的容器运行时
+func (r *PodResource) DebugEphemeral() (*EphemeralDebug, error) {
+	pod, err := r.Get()
+	if err != nil {
+		return nil, err
+	}
+	target := r.Container
+	if target == "" && len(pod.Spec.Containers) > 0 {
+		target = pod.Spec.Containers[0].Name
+	}
+	found := false
+	for _, c := range pod.Spec.Containers {
+		if c.Name == target {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("container %s not found in pod %s", target, pod.Name)
+	}
+	container := v1.EphemeralContainer{
+		EphemeralContainerCommon: v1.EphemeralContainerCommon{
+			Name:                     EphemeralDebugPrefix + rand.String(5),
+			Image:                    r.DebugImage,
+			ImagePullPolicy:          v1.PullIfNotPresent,
+			Stdin:                    true,
+			TTY:                      true,
+			TerminationMessagePolicy: v1.TerminationMessageReadFile,
+		},
+		TargetContainerName: target,
+	}
+	if r.EntryPoint != "" {
+		container.Command = []string{r.EntryPoint}
+	}
+	if err := r.addEphemeralContainer(pod, container); err != nil {
+		return nil, err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Pod,
+		ActionType: common.Debug,
+		Resources:  r.Params,
+		Name:       pod.Name,
+		PostData:   container,
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return nil, err
+	}
+	watcher, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Watch(metav1.SingleObject(pod.ObjectMeta))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	event, err := watch.UntilWithoutRetry(ctx, watcher, ephemeralContainerRunning(container.Name))
+	if err != nil {
+		return nil, err
+	}
+	return &EphemeralDebug{
+		Mode:      DebugModeEphemeral,
+		Pod:       event.Object.(*v1.Pod),
+		Container: container.Name,
+	}, nil
+}
+
+// 根据集群版本选择ephemeralcontainers子资源的调用方式，不支持时返回errEphemeralUnsupported
+func (r *PodResource) addEphemeralContainer(pod *v1.Pod, container v1.EphemeralContainer) error {
+	info, err := r.Params.ClientSet.Discovery().ServerVersion()
+	if err != nil {
+		return err
+	}
+	serverVersion, err := version.ParseGeneric(info.GitVersion)
+	if err != nil {
+		return err
+	}
+	if !serverVersion.AtLeast(ephemeralContainersVersion) {
+		return errEphemeralUnsupported
+	}
+	pods := r.Params.ClientSet.CoreV1().Pods(pod.Namespace)
+	if serverVersion.AtLeast(ephemeralContainersPodAPI) {
+		patch, err := json.Marshal(map[string]interface{}{
+			"spec": map[string]interface{}{
+				"ephemeralContainers": []v1.EphemeralContainer{container},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = pods.Patch(pod.Name, types.StrategicMergePatchType, patch, "ephemeralcontainers")
+		return ephemeralError(err)
+	}
+	// 1.16到1.21需要开启EphemeralContainers特性，ephemeralcontainers子资源使用EphemeralContainers对象
+	ephemeralContainers, err := pods.GetEphemeralContainers(pod.Name, metav1.GetOptions{})
+	if err != nil {
+		return ephemeralError(err)
+	}
+	ephemeralContainers.EphemeralContainers = append(ephemeralContainers.EphemeralContainers, container)
+	_, err = pods.UpdateEphemeralContainers(pod.Name, ephemeralContainers)
+	return ephemeralError(err)
+}
+
+// 特性未开启时ephemeralcontainers子资源不存在，返回404
+func ephemeralError(err error) error {
+	if k8serrors.IsNotFound(err) {
+		if status, ok := err.(k8serrors.APIStatus); ok && (status.Status().Details == nil || status.Status().Details.Name == "") {
+			return errEphemeralUnsupported
+		}
+	}
+	if err != nil {
+		log.Errorf("Add ephemeral container error:%s", err)
+	}
+	return err
+}
+
+func ephemeralContainerRunning(name string) watch.ConditionFunc {
+	return func(event watchType.Event) (bool, error) {
+		switch event.Type {
+		case watchType.Deleted:
+			return false, fmt.Errorf("pod not find")
+		}
+		if pod, ok := event.Object.(*v1.Pod); ok {
+			for _, status := range pod.Status.EphemeralContainerStatuses {
+				if status.Name != name {
+					continue
+				}
+				if status.State.Running != nil {
+					return true, nil
+				}
+				if status.State.Terminated != nil {
+					return false, fmt.Errorf("ephemeral container %s terminated: %s", name, status.State.Terminated.Reason)
+				}
+			}
+		}
+		return false, nil
+	}
+}
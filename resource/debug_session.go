@@ -0,0 +1,295 @@
+package resource
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"github.com/open-kingfisher/king-utils/db"
+	"github.com/open-kingfisher/king-utils/middleware/jwt"
+	"k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	DebugSessionExtend = common.ActionType("debug_session_extend")
+	DebugSessionDelete = common.ActionType("debug_session_delete")
+	// 调试、救援、节点终端Pod的标签，值为会话类型
+	DebugSessionLabel     = "kingfisher.io/session"
+	DebugSessionDebug     = "debug"
+	DebugSessionRescue    = "rescue"
+	DebugSessionNodeShell = "node-shell"
+	// 过期时间、创建用户以及调试目标
+	DebugSessionExpire = "kingfisher.io/expire"
+	DebugSessionUser   = "kingfisher.io/user"
+	DebugSessionTarget = "kingfisher.io/target"
+)
+
+// 调试会话的默认存活时间以及最长存活时间，可以通过启动参数修改
+var (
+	DebugSessionTTL    = 4 * time.Hour
+	DebugSessionMaxTTL = 24 * time.Hour
+)
+
+type DebugSession struct {
+	Name      string      `json:"name"`
+	Namespace string      `json:"namespace"`
+	Type      string      `json:"type"`
+	Target    string      `json:"target"`
+	User      string      `json:"user"`
+	Node      string      `json:"node"`
+	Phase     v1.PodPhase `json:"phase"`
+	Create    int64       `json:"create"`
+	Expire    int64       `json:"expire"`
+}
+
+type DebugSessionResource struct {
+	Params *handle.Resources
+	// 平台管理员可以查看集群中所有命名空间的会话
+	Admin bool
+	TTL   int64
+}
+
+// 列出集群中的调试、救援以及节点终端Pod
+func (r *DebugSessionResource) List() ([]*DebugSession, error) {
+	namespace := r.Params.Namespace
+	if r.Admin {
+		namespace = v1.NamespaceAll
+	}
+	pods, err := r.Params.ClientSet.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: DebugSessionLabel})
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*DebugSession, 0, len(pods.Items))
+	for _, pod := range pods.Items {
+		sessions = append(sessions, &DebugSession{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Type:      pod.Labels[DebugSessionLabel],
+			Target:    pod.Annotations[DebugSessionTarget],
+			User:      pod.Annotations[DebugSessionUser],
+			Node:      pod.Spec.NodeName,
+			Phase:     pod.Status.Phase,
+			Create:    pod.CreationTimestamp.Unix(),
+			Expire:    debugSessionExpire(&pod),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Create > sessions[j].Create
+	})
+	return sessions, nil
+}
+
+// 延长会话的存活时间，不能超过创建时间加上最长存活时间
+func (r *DebugSessionResource) Extend() (*DebugSession, error) {
+	pod, err := r.getSessionPod()
+	if err != nil {
+		return nil, err
+	}
+	ttl := r.TTL
+	if ttl <= 0 {
+		ttl = int64(DebugSessionTTL.Seconds())
+	}
+	expire := time.Now().Add(time.Duration(ttl) * time.Second)
+	if max := pod.CreationTimestamp.Add(DebugSessionMaxTTL); expire.After(max) {
+		expire = max
+	}
+	if err := patchDebugSessionExpire(r.Params.ClientSet, pod, expire); err != nil {
+		return nil, err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Pod,
+		ActionType: DebugSessionExtend,
+		Resources:  r.Params,
+		Name:       pod.Name,
+		PostData:   map[string]interface{}{"expire": expire.Unix()},
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return nil, err
+	}
+	return &DebugSession{
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		Type:      pod.Labels[DebugSessionLabel],
+		Target:    pod.Annotations[DebugSessionTarget],
+		User:      pod.Annotations[DebugSessionUser],
+		Node:      pod.Spec.NodeName,
+		Phase:     pod.Status.Phase,
+		Create:    pod.CreationTimestamp.Unix(),
+		Expire:    expire.Unix(),
+	}, nil
+}
+
+// 结束会话，删除Pod
+func (r *DebugSessionResource) Delete() error {
+	pod, err := r.getSessionPod()
+	if err != nil {
+		return err
+	}
+	if err := deleteDebugSessionPod(r.Params.ClientSet, pod); err != nil {
+		return err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Pod,
+		ActionType: DebugSessionDelete,
+		Resources:  r.Params,
+		Name:       pod.Name,
+	}
+	return auditLog.InsertAuditLog()
+}
+
+func (r *DebugSessionResource) getSessionPod() (*v1.Pod, error) {
+	pod, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Get(r.Params.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if pod.Labels[DebugSessionLabel] == "" {
+		return nil, errors.New("not a debug session pod")
+	}
+	return pod, nil
+}
+
+// 给Pod加上会话标签以及过期时间，ttl为0时使用默认存活时间
+func markDebugSession(pod *v1.Pod, sessionType, target string, user *jwt.CustomClaims, ttl int64) {
+	if ttl <= 0 {
+		ttl = int64(DebugSessionTTL.Seconds())
+	}
+	if max := int64(DebugSessionMaxTTL.Seconds()); ttl > max {
+		ttl = max
+	}
+	labels := map[string]string{DebugSessionLabel: sessionType}
+	for k, v := range pod.Labels {
+		labels[k] = v
+	}
+	var userName string
+	if user != nil {
+		userName = user.Name
+	}
+	annotations := map[string]string{
+		DebugSessionExpire: strconv.FormatInt(time.Now().Add(time.Duration(ttl)*time.Second).Unix(), 10),
+		DebugSessionUser:   userName,
+		DebugSessionTarget: target,
+	}
+	for k, v := range pod.Annotations {
+		annotations[k] = v
+	}
+	pod.Labels = labels
+	pod.Annotations = annotations
+	// 服务不可用时同样保证Pod不会超过最长存活时间
+	activeDeadline := int64(DebugSessionMaxTTL.Seconds())
+	pod.Spec.ActiveDeadlineSeconds = &activeDeadline
+}
+
+// 创建会话Pod，同名的会话Pod仍在运行时直接复用，已经结束的删除后重新创建
+func createDebugSessionPod(clientSet *kubernetes.Clientset, spec *v1.Pod) (*v1.Pod, error) {
+	pods := clientSet.CoreV1().Pods(spec.Namespace)
+	pod, err := pods.Create(spec)
+	if err == nil || !k8serrors.IsAlreadyExists(err) {
+		return pod, err
+	}
+	existing, getErr := pods.Get(spec.Name, metav1.GetOptions{})
+	if getErr != nil || existing.Labels[DebugSessionLabel] != spec.Labels[DebugSessionLabel] {
+		return nil, err
+	}
+	if existing.DeletionTimestamp == nil && (existing.Status.Phase == v1.PodPending || existing.Status.Phase == v1.PodRunning) {
+		expire, _ := strconv.ParseInt(spec.Annotations[DebugSessionExpire], 10, 64)
+		if err := patchDebugSessionExpire(clientSet, existing, time.Unix(expire, 0)); err != nil {
+			return nil, err
+		}
+		log.Infof("Reuse debug session pod: %s/%s", existing.Namespace, existing.Name)
+		return existing, nil
+	}
+	if err := deleteDebugSessionPod(clientSet, existing); err != nil && !k8serrors.IsNotFound(err) {
+		return nil, err
+	}
+	// 等待旧的Pod删除完成
+	err = wait.PollImmediate(time.Second, time.Minute, func() (bool, error) {
+		_, err := pods.Get(spec.Name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Create(spec)
+}
+
+func patchDebugSessionExpire(clientSet *kubernetes.Clientset, pod *v1.Pod, expire time.Time) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{DebugSessionExpire: strconv.FormatInt(expire.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientSet.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.StrategicMergePatchType, patch)
+	return err
+}
+
+func deleteDebugSessionPod(clientSet *kubernetes.Clientset, pod *v1.Pod) error {
+	gracePeriod := int64(0)
+	if pod.Labels[DebugSessionLabel] == DebugSessionDebug {
+		// 调试Pod需要执行PreStop删除节点上的调试容器
+		gracePeriod = 30
+	}
+	return clientSet.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod})
+}
+
+// 过期时间，没有过期时间的按照创建时间加上默认存活时间计算
+func debugSessionExpire(pod *v1.Pod) int64 {
+	if expire, err := strconv.ParseInt(pod.Annotations[DebugSessionExpire], 10, 64); err == nil {
+		return expire
+	}
+	return pod.CreationTimestamp.Add(DebugSessionTTL).Unix()
+}
+
+// 定期清理所有集群中过期的会话Pod
+func DebugSessionReaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		clusters := make([]*common.ClusterDB, 0)
+		if err := db.List(common.DataField, common.Cluster, &clusters, ""); err != nil {
+			log.Errorf("Debug session reaper list cluster error: %s", err)
+			continue
+		}
+		for _, cluster := range clusters {
+			if err := reapDebugSession(cluster.Id); err != nil {
+				log.Errorf("Debug session reaper cluster %s error: %s", cluster.Id, err)
+			}
+		}
+	}
+}
+
+func reapDebugSession(cluster string) error {
+	clientSet, err := access.Access(cluster)
+	if err != nil {
+		return err
+	}
+	pods, err := clientSet.CoreV1().Pods(v1.NamespaceAll).List(metav1.ListOptions{LabelSelector: DebugSessionLabel})
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || debugSessionExpire(pod) > now {
+			continue
+		}
+		log.Infof("Debug session %s/%s expired, cluster: %s", pod.Namespace, pod.Name, cluster)
+		if err := deleteDebugSessionPod(clientSet, pod); err != nil && !k8serrors.IsNotFound(err) {
+			log.Errorf("Delete expired debug session %s/%s error: %s", pod.Namespace, pod.Name, err)
+		}
+	}
+	return nil
+}
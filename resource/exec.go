@@ -0,0 +1,194 @@
+package resource
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"io"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+	utilexec "k8s.io/client-go/util/exec"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	PodExec = common.ActionType("exec")
+	// 默认超时时间和最大超时时间，单位秒
+	ExecDefaultTimeout = 30
+	ExecMaxTimeout     = 600
+	// stdout和stderr各自最多返回1M
+	ExecOutputLimit = 1024 * 1024
+)
+
+type ExecOptions struct {
+	Command   []string `json:"command" binding:"required"`
+	Container string   `json:"container"`
+	Timeout   int64    `json:"timeout"`
+}
+
+type ExecResult struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// 在容器中执行一次性命令，不分配TTY，返回stdout、stderr以及退出码
+func (r *PodResource) Exec() (*ExecResult, error) {
+	if r.ExecData == nil || len(r.ExecData.Command) == 0 {
+		return nil, errors.New("command cannot be empty")
+	}
+	if r.ExecData.Container == "" {
+		r.ExecData.Container = r.Container
+	}
+	timeout := r.ExecData.Timeout
+	if timeout <= 0 {
+		timeout = ExecDefaultTimeout
+	}
+	if timeout > ExecMaxTimeout {
+		timeout = ExecMaxTimeout
+	}
+	if err := r.checkTargetPod(); err != nil {
+		return nil, err
+	}
+	// 执行前记录审计日志，超时的命令同样可以追溯
+	auditLog := handle.AuditLog{
+		Kind:       common.Pod,
+		ActionType: PodExec,
+		Resources:  r.Params,
+		Name:       r.Params.Name,
+		PostData:   r.ExecData,
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return nil, err
+	}
+	stdout := &limitBuffer{limit: ExecOutputLimit}
+	stderr := &limitBuffer{limit: ExecOutputLimit}
+	conn := &execConnection{}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- r.streamConnection(&v1.PodExecOptions{
+			Container: r.ExecData.Container,
+			Command:   r.ExecData.Command,
+			Stdout:    true,
+			Stderr:    true,
+		}, nil, stdout, stderr, conn)
+	}()
+	result := &ExecResult{}
+	var err error
+	select {
+	case err = <-errCh:
+	case <-time.After(time.Duration(timeout) * time.Second):
+		// 超时后断开连接，执行流随之结束，容器中的进程不会被终止
+		conn.Close()
+		return nil, fmt.Errorf("command timed out after %d seconds", timeout)
+	}
+	if err != nil {
+		if exitErr, ok := err.(utilexec.CodeExitError); ok {
+			result.ExitCode = exitErr.Code
+		} else {
+			log.Errorf("Pod exec error:%s; Command:%v; Name:%s", err, r.ExecData.Command, r.Params.Name)
+			return nil, err
+		}
+	}
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	return result, nil
+}
+
+// 通过SPDY在容器中执行命令，与终端使用相同的remotecommand执行器
+func (r *PodResource) stream(options *v1.PodExecOptions, stdin io.Reader, stdout, stderr io.Writer) error {
+	return r.streamConnection(options, stdin, stdout, stderr, &execConnection{})
+}
+
+// 记录建立的SPDY连接，调用方可以通过conn主动断开执行流
+func (r *PodResource) streamConnection(options *v1.PodExecOptions, stdin io.Reader, stdout, stderr io.Writer, conn *execConnection) error {
+	config, err := access.GetConfig(r.Params.Cluster)
+	if err != nil {
+		return err
+	}
+	req := r.Params.ClientSet.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Name(r.Params.Name).
+		Namespace(r.Params.Namespace).
+		SubResource("exec")
+	req.VersionedParams(options, scheme.ParameterCodec)
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return err
+	}
+	executor, err := remotecommand.NewSPDYExecutorForTransports(transport, conn.Upgrader(upgrader), http.MethodPost, req.URL())
+	if err != nil {
+		return err
+	}
+	return executor.Stream(remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
+
+// 执行流的SPDY连接，关闭后建立的连接同样立即关闭
+type execConnection struct {
+	mu     sync.Mutex
+	conn   httpstream.Connection
+	closed bool
+}
+
+func (c *execConnection) Upgrader(upgrader spdy.Upgrader) spdy.Upgrader {
+	return &execUpgrader{upgrader: upgrader, conn: c}
+}
+
+func (c *execConnection) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+type execUpgrader struct {
+	upgrader spdy.Upgrader
+	conn     *execConnection
+}
+
+func (u *execUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := u.upgrader.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+	u.conn.mu.Lock()
+	defer u.conn.mu.Unlock()
+	if u.conn.closed {
+		conn.Close()
+		return nil, errors.New("exec stream has been closed")
+	}
+	u.conn.conn = conn
+	return conn, nil
+}
+
+// 超过限制的输出直接丢弃
+type limitBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitBuffer) Write(p []byte) (int, error) {
+	if left := b.limit - b.Len(); left > 0 {
+		if len(p) > left {
+			b.Buffer.Write(p[:left])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,256 @@
+package resource
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"io"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 所有日志流输出的总字节数达到LimitBytes
+var errLogLimitReached = errors.New("log limit reached")
+
+// 多个日志流并发写入同一个输出，按行加锁写入，避免不同容器的日志行交错
+// limit不为空时限制所有日志流输出的总字节数，达到限制后返回errLogLimitReached
+type LogWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	limit   *int64
+	written int64
+}
+
+func NewLogWriter(w io.Writer, limit *int64) *LogWriter {
+	return &LogWriter{w: w, limit: limit}
+}
+
+func (l *LogWriter) WriteLine(prefix string, line []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if prefix != "" {
+		line = append([]byte(prefix), line...)
+	}
+	if l.limit != nil {
+		remain := *l.limit - l.written
+		if remain <= 0 {
+			return errLogLimitReached
+		}
+		if int64(len(line)) > remain {
+			line = line[:remain]
+		}
+	}
+	n, err := l.w.Write(line)
+	l.written += int64(n)
+	if err == nil && l.limit != nil && l.written >= *l.limit {
+		err = errLogLimitReached
+	}
+	return err
+}
+
+// 读取单个容器的日志流，每一行加上前缀后写入LogWriter，ctx取消后返回nil
+func streamContainerLog(ctx context.Context, clientSet *kubernetes.Clientset, namespace, pod string, options *v1.PodLogOptions, prefix string, w *LogWriter) error {
+	return readContainerLog(ctx, clientSet, namespace, pod, options, func(line []byte) error {
+		return w.WriteLine(prefix, line)
+	})
+}
+
+// 读取单个容器的日志流，每一行交给handle处理，ctx取消后返回nil
+func readContainerLog(ctx context.Context, clientSet *kubernetes.Clientset, namespace, pod string, options *v1.PodLogOptions, handle func(line []byte) error) error {
+	stream, err := clientSet.CoreV1().Pods(namespace).GetLogs(pod, options).Context(ctx).Stream()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer stream.Close()
+	reader := bufio.NewReader(stream)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if err := handle(line); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// 聚合输出labelSelector匹配到的所有Pod的日志，每行加上"[pod/container] "前缀
+// follow模式下监听Pod的变化，新创建的Pod和重启的容器自动加入，删除的Pod停止读取
+// LimitBytes限制的是所有容器日志的总大小
+func streamSelectorLog(ctx context.Context, clientSet *kubernetes.Clientset, namespace, selector string, options *v1.PodLogOptions, initContainers bool, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	writer := NewLogWriter(w, options.LimitBytes)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	// key为pod/container/restartCount，容器重启后重新开始读取
+	streams := make(map[string]context.CancelFunc)
+	// 每个容器已经输出的最后一行的时间，容器重启后从此时间之后继续读取，不重复输出
+	var sentLock sync.Mutex
+	lastSent := make(map[string]time.Time)
+	start := func(pod *v1.Pod) {
+		for _, status := range logContainerStatuses(pod, options.Previous, initContainers) {
+			if options.Container != "" && options.Container != status.Name {
+				continue
+			}
+			// 容器还没有启动无法获取日志
+			if status.State.Running == nil && status.State.Terminated == nil {
+				continue
+			}
+			key := fmt.Sprintf("%s/%s/%d", pod.Name, status.Name, status.RestartCount)
+			if _, ok := streams[key]; ok {
+				continue
+			}
+			streamCtx, streamCancel := context.WithCancel(ctx)
+			streams[key] = streamCancel
+			opts := options.DeepCopy()
+			opts.Container = status.Name
+			// 总是带上时间戳读取，用于记录输出位置，用户没有要求时输出前去掉
+			opts.Timestamps = true
+			containerKey := pod.Name + "/" + status.Name
+			sentLock.Lock()
+			after, resumed := lastSent[containerKey]
+			sentLock.Unlock()
+			if resumed {
+				opts.SinceTime = &metav1.Time{Time: after}
+				opts.SinceSeconds = nil
+				opts.TailLines = nil
+			}
+			prefix := "[" + containerKey + "] "
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				err := readContainerLog(streamCtx, clientSet, namespace, name, opts, func(line []byte) error {
+					t, content := splitLogTimestamp(line)
+					// SinceTime只精确到秒，跳过已经输出过的行
+					if resumed && !t.IsZero() && !t.After(after) {
+						return nil
+					}
+					if !options.Timestamps {
+						line = content
+					}
+					if err := writer.WriteLine(prefix, line); err != nil {
+						return err
+					}
+					if !t.IsZero() {
+						sentLock.Lock()
+						lastSent[containerKey] = t
+						sentLock.Unlock()
+					}
+					return nil
+				})
+				if err == errLogLimitReached {
+					cancel()
+				} else if err != nil {
+					log.Errorf("Pod log stream error:%s; Name:%s; Container:%s", err, name, opts.Container)
+				}
+			}(pod.Name)
+		}
+	}
+	stop := func(pod *v1.Pod) {
+		for key, streamCancel := range streams {
+			if strings.HasPrefix(key, pod.Name+"/") {
+				streamCancel()
+				delete(streams, key)
+			}
+		}
+	}
+
+	if !options.Follow {
+		pods, err := clientSet.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+		for i := range pods.Items {
+			start(&pods.Items[i])
+		}
+		wg.Wait()
+		return nil
+	}
+	for {
+		watcher, err := clientSet.CoreV1().Pods(namespace).Watch(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+		if done := watchSelectorPods(ctx, watcher, start, stop); done {
+			return nil
+		}
+		// 服务端超时关闭了watch，重新建立watch，已经在读取的容器不会重复读取
+		log.Infof("Pod watch closed, rewatch selector: %s", selector)
+	}
+}
+
+// 拆分日志行开头的RFC3339Nano时间戳，没有时间戳时返回零值和原始内容
+func splitLogTimestamp(line []byte) (time.Time, []byte) {
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		return time.Time{}, line
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(line[:i]))
+	if err != nil {
+		return time.Time{}, line
+	}
+	return t, line[i+1:]
+}
+
+// 需要读取日志的容器状态，默认不包含initContainers，读取上一个实例的日志时跳过没有重启过的容器
+func logContainerStatuses(pod *v1.Pod, previous, initContainers bool) []v1.ContainerStatus {
+	statuses := make([]v1.ContainerStatus, 0, len(pod.Status.InitContainerStatuses)+len(pod.Status.ContainerStatuses))
+	if initContainers {
+		statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	}
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	if !previous {
+		return statuses
+	}
+	restarted := statuses[:0]
+	for _, status := range statuses {
+		if status.RestartCount > 0 {
+			restarted = append(restarted, status)
+		}
+	}
+	return restarted
+}
+
+// 处理Pod的watch事件，ctx结束返回true，watch被关闭返回false
+func watchSelectorPods(ctx context.Context, watcher watch.Interface, start, stop func(pod *v1.Pod)) bool {
+	defer watcher.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				return false
+			}
+			pod, ok := event.Object.(*v1.Pod)
+			if !ok {
+				continue
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				start(pod)
+			case watch.Deleted:
+				stop(pod)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package resource
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"io"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"time"
+)
+
+const (
+	LogBundlePod        = "pod"
+	LogBundleController = "controller"
+	LogBundleNamespace  = "namespace"
+	// 每个容器日志默认最多收集10M，避免打包过大
+	LogBundleLimitBytes = 10 * 1024 * 1024
+)
+
+// 将Pod、控制器或者整个命名空间的日志、事件以及Pod描述打包成tar.gz
+type LogBundleResource struct {
+	Params       *handle.Resources
+	Kind         string
+	SinceSeconds *int64
+	TailLines    *int64
+	LimitBytes   *int64
+}
+
+// 获取需要打包的Pod
+func (r *LogBundleResource) ListPod() ([]v1.Pod, error) {
+	switch r.Kind {
+	case LogBundlePod:
+		pod, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Get(r.Params.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return []v1.Pod{*pod}, nil
+	case LogBundleController:
+		controller := ControllerResource{Params: r.Params}
+		pods, err := controller.ListPodByController()
+		if err != nil {
+			return nil, err
+		}
+		return pods.Items, nil
+	case LogBundleNamespace:
+		pods, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).List(metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return pods.Items, nil
+	default:
+		return nil, errors.New("log bundle kind doesn't exist")
+	}
+}
+
+func (r *LogBundleResource) FileName() string {
+	name := r.Params.Namespace
+	if r.Kind != LogBundleNamespace {
+		name = r.Params.Namespace + "-" + r.Params.Name
+	}
+	return fmt.Sprintf("%s-%s-%s.tar.gz", r.Kind, name, time.Now().Format("20060102150405"))
+}
+
+// 打包内容：pods/<pod>.json、logs/<pod>/<container>.log、logs/<pod>/<container>.previous.log、events.json
+func (r *LogBundleResource) Export(pods []v1.Pod, w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, pod := range pods {
+		spec, err := json.MarshalIndent(pod, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, "pods/"+pod.Name+".json", spec); err != nil {
+			return err
+		}
+		for _, container := range podContainerNames(&pod) {
+			current, err := r.containerLog(pod.Name, container, false)
+			if err != nil {
+				// 容器没有启动等情况下获取不到日志，把错误写入日志文件
+				current = []byte(err.Error() + "\n")
+			}
+			if err := writeTarFile(tw, "logs/"+pod.Name+"/"+container+".log", current); err != nil {
+				return err
+			}
+			// 容器没有重启过没有previous日志，忽略错误
+			if previous, err := r.containerLog(pod.Name, container, true); err == nil {
+				if err := writeTarFile(tw, "logs/"+pod.Name+"/"+container+".previous.log", previous); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	events, err := r.listEvent(pods)
+	if err != nil {
+		log.Errorf("Log bundle list event error:%s; Name:%s", err, r.Params.Name)
+	} else {
+		data, err := json.MarshalIndent(events, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, "events.json", data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func (r *LogBundleResource) containerLog(pod, container string, previous bool) ([]byte, error) {
+	limitBytes := r.LimitBytes
+	if limitBytes == nil {
+		var defaultLimit int64 = LogBundleLimitBytes
+		limitBytes = &defaultLimit
+	}
+	return r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).GetLogs(pod, &v1.PodLogOptions{
+		Container:    container,
+		Previous:     previous,
+		SinceSeconds: r.SinceSeconds,
+		TailLines:    r.TailLines,
+		LimitBytes:   limitBytes,
+	}).Do().Raw()
+}
+
+// 获取打包对象相关的事件，命名空间打包时返回所有事件
+func (r *LogBundleResource) listEvent(pods []v1.Pod) ([]v1.Event, error) {
+	params := *r.Params
+	params.Uid = ""
+	event := EventResource{Params: &params}
+	eventList, err := event.List()
+	if err != nil {
+		return nil, err
+	}
+	if r.Kind == LogBundleNamespace {
+		return eventList.Items, nil
+	}
+	names := make(map[string]bool)
+	for _, pod := range pods {
+		names[pod.Name] = true
+	}
+	events := make([]v1.Event, 0)
+	for _, e := range eventList.Items {
+		name := e.InvolvedObject.Name
+		// 控制器的事件以及ReplicaSet（名称为控制器名称加hash）的事件
+		if names[name] || (r.Kind == LogBundleController && (name == r.Params.Name || strings.HasPrefix(name, r.Params.Name+"-"))) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, bytes.NewReader(data))
+	return err
+}
@@ -0,0 +1,59 @@
+package resource
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestLogWriterLimit(t *testing.T) {
+	limit := int64(11)
+	buf := &bytes.Buffer{}
+	writer := NewLogWriter(buf, &limit)
+	if err := writer.WriteLine("[a] ", []byte("1\n")); err != nil {
+		t.Fatalf("WriteLine() error: %v", err)
+	}
+	// 超过限制的部分被截断，所有日志流共享同一个限制
+	if err := writer.WriteLine("[b] ", []byte("22\n")); err != errLogLimitReached {
+		t.Fatalf("WriteLine() error = %v, want %v", err, errLogLimitReached)
+	}
+	if err := writer.WriteLine("[a] ", []byte("3\n")); err != errLogLimitReached {
+		t.Fatalf("WriteLine() error = %v, want %v", err, errLogLimitReached)
+	}
+	if got, want := buf.String(), "[a] 1\n[b] 2"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestLogWriterNoLimit(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := NewLogWriter(buf, nil)
+	for i := 0; i < 3; i++ {
+		if err := writer.WriteLine("", []byte("line\n")); err != nil {
+			t.Fatalf("WriteLine() error: %v", err)
+		}
+	}
+	if got, want := buf.String(), "line\nline\nline\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestSplitLogTimestamp(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    time.Time
+		content string
+	}{
+		{"2026-10-17T10:07:30.123456789Z hello world\n", time.Date(2026, 10, 17, 10, 7, 30, 123456789, time.UTC), "hello world\n"},
+		{"2026-10-17T10:07:30Z \n", time.Date(2026, 10, 17, 10, 7, 30, 0, time.UTC), "\n"},
+		// 没有时间戳时保留原始内容
+		{"hello world\n", time.Time{}, "hello world\n"},
+		{"hello\n", time.Time{}, "hello\n"},
+	}
+	for _, test := range tests {
+		got, content := splitLogTimestamp([]byte(test.line))
+		if !got.Equal(test.want) || string(content) != test.content {
+			t.Errorf("splitLogTimestamp(%q) = %v, %q, want %v, %q", test.line, got, content, test.want, test.content)
+		}
+	}
+}
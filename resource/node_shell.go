@@ -0,0 +1,151 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"github.com/open-kingfisher/king-utils/middleware/jwt"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/watch"
+	"strconv"
+	"time"
+)
+
+const (
+	NodeShell       = common.ActionType("node_shell")
+	NodeShellPrefix = "node-shell-"
+)
+
+// 进入节点1号进程的命名空间，后面跟要执行的shell
+var NodeShellCommand = []string{"nsenter", "--target", "1", "--mount", "--uts", "--ipc", "--net", "--pid", "--"}
+
+// 节点终端等同于节点的root权限，默认只允许平台管理员使用
+// 关闭后有命名空间权限的用户也可以使用，适用于开发人员没有节点SSH权限的场景
+var NodeShellAdminOnly = true
+
+// 在节点上创建特权Pod，通过nsenter进入节点的命名空间，然后使用终端连接此Pod
+// 节点终端Pod作为调试会话管理，到期后由DebugSessionReaper删除
+func (r *NodeResource) Shell(image string, ttl int64) (*v1.Pod, error) {
+	node, err := r.Get()
+	if err != nil {
+		return nil, err
+	}
+	podSpec := r.getShellPodSpec(node.Name, image)
+	markDebugSession(podSpec, DebugSessionNodeShell, node.Name, r.Params.User, ttl)
+	pod, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Create(podSpec)
+	if err != nil {
+		log.Errorf("Node shell pod create error:%s; Node:%s", err, node.Name)
+		return nil, err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Node,
+		ActionType: NodeShell,
+		Resources:  r.Params,
+		Name:       node.Name,
+		PostData:   map[string]interface{}{"pod": pod.Name, "namespace": pod.Namespace, "image": image, "ttl": ttl},
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		DeleteNodeShellPod(r.Params, pod.Name)
+		return nil, err
+	}
+	watcher, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Watch(metav1.SingleObject(pod.ObjectMeta))
+	if err != nil {
+		DeleteNodeShellPod(r.Params, pod.Name)
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if _, err = watch.UntilWithoutRetry(ctx, watcher, PodRunning); err != nil {
+		DeleteNodeShellPod(r.Params, pod.Name)
+		return nil, err
+	}
+	return r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Get(pod.Name, metav1.GetOptions{})
+}
+
+// 删除节点终端Pod，只删除带有节点终端标签的Pod
+func DeleteNodeShellPod(params *handle.Resources, name string) error {
+	pods := params.ClientSet.CoreV1().Pods(params.Namespace)
+	pod, err := pods.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if !IsNodeShellPod(pod) {
+		return errors.New("not a node shell pod")
+	}
+	gracePeriod := int64(0)
+	if err := pods.Delete(name, &metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod}); err != nil {
+		log.Errorf("Node shell pod delete error:%s; Name:%s", err, name)
+		return err
+	}
+	return nil
+}
+
+// 是否为节点终端Pod
+func IsNodeShellPod(pod *v1.Pod) bool {
+	return pod.Labels[DebugSessionLabel] == DebugSessionNodeShell
+}
+
+// 是否允许用户使用节点终端
+func CheckNodeShellAccess(user *jwt.CustomClaims) error {
+	if NodeShellAdminOnly {
+		return CheckPlatformAdmin(user)
+	}
+	return nil
+}
+
+// 节点终端Pod只能由创建它的用户连接，其他用户连接特权Pod同样可以拿到节点的root权限
+func CheckNodeShellOwner(pod *v1.Pod, user *jwt.CustomClaims) error {
+	if err := CheckNodeShellAccess(user); err != nil {
+		return err
+	}
+	if pod.Annotations[DebugSessionUser] != user.Name {
+		return errors.New("node shell pod belongs to another user")
+	}
+	return nil
+}
+
+// 节点终端和抓包Pod都是特权Pod，不允许通过命令执行、文件传输、日志以及调试接口访问
+func checkPrivilegedSessionPod(pod *v1.Pod) error {
+	switch pod.Labels[DebugSessionLabel] {
+	case DebugSessionNodeShell, DebugSessionCapture:
+		return fmt.Errorf("pod %s is a privileged %s session pod", pod.Name, pod.Labels[DebugSessionLabel])
+	}
+	return nil
+}
+
+func (r *NodeResource) getShellPodSpec(node, image string) *v1.Pod {
+	privileged := true
+	gracePeriod := int64(0)
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: NodeShellPrefix,
+			Namespace:    r.Params.Namespace,
+			Annotations:  DisableIsitoInject, // 不开启istio注入
+		},
+		Spec: v1.PodSpec{
+			NodeName:    node, // 固定在要进入的节点上
+			HostPID:     true,
+			HostNetwork: true,
+			HostIPC:     true,
+			Containers: []v1.Container{
+				{
+					Name:            "node-shell",
+					Image:           image,
+					ImagePullPolicy: v1.PullIfNotPresent,
+					Command:         []string{"sleep", strconv.FormatInt(int64(DebugSessionMaxTTL.Seconds()), 10)},
+					SecurityContext: &v1.SecurityContext{
+						Privileged: &privileged,
+					},
+				},
+			},
+			// 容忍所有污点，保证可以调度到任意节点
+			Tolerations:                   []v1.Toleration{{Operator: v1.TolerationOpExists}},
+			TerminationGracePeriodSeconds: &gracePeriod,
+			RestartPolicy:                 v1.RestartPolicyNever,
+		},
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/open-kingfisher/king-utils/common/log"
 	"github.com/open-kingfisher/king-utils/db"
 	"github.com/open-kingfisher/king-utils/kit"
+	"io"
 	appv1 "k8s.io/api/apps/v1"
 	"k8s.io/api/core/v1"
 	policy "k8s.io/api/policy/v1beta1"
@@ -19,6 +20,7 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 	watchType "k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/tools/watch"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -52,6 +54,16 @@ type PodResource struct {
 	KubectlVersion  string   `json:"kubectlVersion "`
 	Plugin          string   `json:"plugin "`
 	RescueCondition []string `json:"rescueCondition"`
+	Follow          bool     `json:"follow"`
+	TailLines       *int64   `json:"tailLines"`
+	Timestamps      bool     `json:"timestamps"`
+	Previous        bool     `json:"previous"`
+	InitContainers  bool     `json:"initContainers"`
+	LimitBytes      *int64   `json:"limitBytes"`
+	ExecData        *ExecOptions
+	FilePath        string `json:"filePath"`
+	DebugMode       string `json:"debugMode"`
+	TTL             int64  `json:"ttl"`
 }
 
 func (r *PodResource) Get() (*v1.Pod, error) {
@@ -69,6 +81,15 @@ func (r *PodResource) Get() (*v1.Pod, error) {
 	return r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Get(r.Params.Name, metav1.GetOptions{})
 }
 
+// 检查目标Pod是否允许执行命令、传输文件、查看日志以及调试
+func (r *PodResource) checkTargetPod() error {
+	pod, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Get(r.Params.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	return checkPrivilegedSessionPod(pod)
+}
+
 func (r *PodResource) List() (*v1.PodList, error) {
 	podItems := &v1.PodList{}
 	if pods, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).List(metav1.ListOptions{}); err == nil {
@@ -175,6 +196,9 @@ func (r *PodResource) Create() (res *v1.Pod, err error) {
 }
 
 func (r *PodResource) Log() (*string, error) {
+	if err := r.checkTargetPod(); err != nil {
+		return nil, err
+	}
 	logRequest := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).GetLogs(r.Params.Name, &v1.PodLogOptions{SinceSeconds: r.SinceSeconds, Container: r.Container})
 	logResponse := logRequest.Do()
 	if podLog, err := logResponse.Raw(); err == nil {
@@ -186,6 +210,62 @@ func (r *PodResource) Log() (*string, error) {
 	}
 }
 
+// 以流的方式获取Pod日志，Container为空时获取所有容器的日志，每行加上容器名前缀
+func (r *PodResource) LogStream(ctx context.Context, w io.Writer) error {
+	pod, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Get(r.Params.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if err := checkPrivilegedSessionPod(pod); err != nil {
+		return err
+	}
+	containers := []string{r.Container}
+	if r.Container == "" {
+		containers = logContainerNames(pod, r.Previous, r.InitContainers)
+		if len(containers) == 0 {
+			return errors.New("no container has a previous instance")
+		}
+	}
+	// LimitBytes限制所有容器日志的总大小，达到限制后结束所有容器的读取
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := NewLogWriter(w, r.LimitBytes)
+	errCh := make(chan error, len(containers))
+	for _, container := range containers {
+		prefix := ""
+		if len(containers) > 1 {
+			prefix = "[" + container + "] "
+		}
+		go func(container, prefix string) {
+			errCh <- streamContainerLog(ctx, r.Params.ClientSet, r.Params.Namespace, r.Params.Name, r.logOptions(container), prefix, writer)
+		}(container, prefix)
+	}
+	for range containers {
+		e := <-errCh
+		if e == errLogLimitReached {
+			cancel()
+			continue
+		}
+		if e != nil && err == nil {
+			log.Errorf("Pod log stream error:%s; Name:%s", e, r.Params.Name)
+			err = e
+		}
+	}
+	return err
+}
+
+func (r *PodResource) logOptions(container string) *v1.PodLogOptions {
+	return &v1.PodLogOptions{
+		Container:    container,
+		Follow:       r.Follow,
+		Previous:     r.Previous,
+		SinceSeconds: r.SinceSeconds,
+		Timestamps:   r.Timestamps,
+		TailLines:    r.TailLines,
+		LimitBytes:   r.LimitBytes,
+	}
+}
+
 func (r *PodResource) Evict() (err error) {
 	// https://kubernetes.io/docs/tasks/administer-cluster/safely-drain-node/#the-eviction-api
 	return r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Evict(&policy.Eviction{
@@ -229,6 +309,21 @@ func (r *PodResource) Event() error {
 
 // 创建Debug Pod
 func (r *PodResource) Debug() (interface{}, error) {
+	if err := r.checkTargetPod(); err != nil {
+		return nil, err
+	}
+	// DebugMode为空时等同于auto，优先使用临时容器，集群不支持时才使用挂载docker.sock的方式
+	if r.DebugMode != DebugModeDocker {
+		result, err := r.DebugEphemeral()
+		if err == nil {
+			return result, nil
+		}
+		if err != errEphemeralUnsupported || r.DebugMode == DebugModeEphemeral {
+			log.Errorf("DebugEphemeral error: %s", err)
+			return nil, err
+		}
+		log.Infof("Ephemeral containers are not supported in cluster %s, fall back to docker debug", r.Params.Cluster)
+	}
 	podInfo, err := r.getContainerIDAndNode()
 	if err != nil {
 		log.Errorf("getContainerIDAndNode error: %s", err)
@@ -239,7 +334,8 @@ func (r *PodResource) Debug() (interface{}, error) {
 		log.Errorf("getDebugPodSpec error: %s", err)
 		return nil, err
 	}
-	pod, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Create(podSpec)
+	markDebugSession(podSpec, DebugSessionDebug, r.Params.Name, r.Params.User, r.TTL)
+	pod, err := createDebugSessionPod(r.Params.ClientSet, podSpec)
 	if err != nil {
 		log.Errorf("Pod create error:%s; Json:%+v; Name:%s", err, podSpec, r.Params.Name)
 		return nil, err
@@ -719,7 +815,8 @@ func (r *PodResource) Rescue() error {
 		return err
 	}
 	podSpec := r.getRescuePodSpec(podInfo)
-	pod, err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Create(podSpec)
+	markDebugSession(podSpec, DebugSessionRescue, r.Params.Name, r.Params.User, r.TTL)
+	pod, err := createDebugSessionPod(r.Params.ClientSet, podSpec)
 	if err != nil {
 		log.Errorf("Rescue pod create error:%s; Json:%+v; Name:%s", err, podSpec, r.Params.Name)
 		return err
@@ -810,8 +907,8 @@ func (r *PodResource) getRescuePodSpec(podInfo *v1.Pod) *v1.Pod {
 			}
 			// 替换command
 			rescueContainer.Command = []string{"sleep"}
-			// 替换args
-			rescueContainer.Args = []string{"24h"}
+			// 替换args，存活时间由会话过期时间控制
+			rescueContainer.Args = []string{strconv.FormatInt(int64(DebugSessionMaxTTL.Seconds()), 10)}
 			// 清除Port
 			rescueContainer.Ports = nil
 			// 清除就绪探针
@@ -850,6 +947,40 @@ func (r *PodResource) GetDebugPodIPByPod() (string, error) {
 	return "", nil
 }
 
+// 获取Pod中所有容器名，包含initContainers
+func podContainerNames(pod *v1.Pod) []string {
+	names := make([]string, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	for _, c := range pod.Spec.InitContainers {
+		names = append(names, c.Name)
+	}
+	for _, c := range pod.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// 读取所有容器日志时的容器名，默认不包含initContainers，previous时只返回重启过的容器
+func logContainerNames(pod *v1.Pod, previous, initContainers bool) []string {
+	if previous {
+		statuses := logContainerStatuses(pod, previous, initContainers)
+		names := make([]string, 0, len(statuses))
+		for _, status := range statuses {
+			names = append(names, status.Name)
+		}
+		return names
+	}
+	names := make([]string, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	if initContainers {
+		for _, c := range pod.Spec.InitContainers {
+			names = append(names, c.Name)
+		}
+	}
+	for _, c := range pod.Spec.Containers {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
 func rescueCondition(conditions []string, condition string) bool {
 	for _, c := range conditions {
 		if condition == c {
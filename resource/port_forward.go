@@ -0,0 +1,204 @@
+package resource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"io"
+	"io/ioutil"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+	"net/http"
+	"strconv"
+)
+
+const PodPortForward = common.ActionType("port_forward")
+
+// 端口转发，指定Service时从Service后端选择一个就绪的Pod
+type PortForwardResource struct {
+	Params  *handle.Resources
+	Service string
+	// 端口号或者端口名称，Service时为Service的端口
+	Port string
+}
+
+// 解析出需要转发的Pod以及容器端口
+func (r *PortForwardResource) Resolve() (*v1.Pod, int32, error) {
+	if r.Service == "" {
+		if r.Port == "" {
+			return nil, 0, errors.New("port cannot be empty")
+		}
+		pod, err := (&PodResource{Params: r.Params}).Get()
+		if err != nil {
+			return nil, 0, err
+		}
+		if pod.Status.Phase != v1.PodRunning {
+			return nil, 0, fmt.Errorf("pod %s is not running", pod.Name)
+		}
+		port, err := containerPort(pod, intstr.Parse(r.Port))
+		return pod, port, err
+	}
+	service := ServiceResource{Params: &handle.Resources{
+		Cluster:   r.Params.Cluster,
+		Namespace: r.Params.Namespace,
+		Name:      r.Service,
+		ClientSet: r.Params.ClientSet,
+	}}
+	svc, err := service.Get()
+	if err != nil {
+		return nil, 0, err
+	}
+	servicePort, err := findServicePort(svc, r.Port)
+	if err != nil {
+		return nil, 0, err
+	}
+	pods, err := service.ListPodByService()
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != v1.PodRunning || pod.DeletionTimestamp != nil || !podReady(pod) {
+			continue
+		}
+		targetPort := servicePort.TargetPort
+		// 未设置targetPort时与port相同
+		if targetPort.Type == intstr.Int && targetPort.IntVal == 0 {
+			targetPort = intstr.FromInt(int(servicePort.Port))
+		}
+		port, err := containerPort(pod, targetPort)
+		if err != nil {
+			continue
+		}
+		return pod, port, nil
+	}
+	return nil, 0, fmt.Errorf("no ready pod for service %s", r.Service)
+}
+
+// 通过SPDY建立到Pod端口的连接，并在conn与该端口之间转发数据，直到任意一端关闭
+func (r *PortForwardResource) Forward(ctx context.Context, pod *v1.Pod, port int32, conn io.ReadWriter) error {
+	auditLog := handle.AuditLog{
+		Kind:       common.Pod,
+		ActionType: PodPortForward,
+		Resources:  r.Params,
+		Name:       pod.Name,
+		PostData:   map[string]interface{}{"service": r.Service, "pod": pod.Name, "port": port},
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return err
+	}
+	config, err := access.GetConfig(r.Params.Cluster)
+	if err != nil {
+		return err
+	}
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return err
+	}
+	req := r.Params.ClientSet.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+	streamConn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return err
+	}
+	defer streamConn.Close()
+
+	// 与kubectl port-forward相同，每个连接创建一个error流和一个data流
+	headers := http.Header{}
+	headers.Set(v1.StreamType, v1.StreamTypeError)
+	headers.Set(v1.PortHeader, strconv.Itoa(int(port)))
+	headers.Set(v1.PortForwardRequestIDHeader, "0")
+	errorStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return err
+	}
+	errorStream.Close()
+	errorCh := make(chan error, 1)
+	go func() {
+		message, err := ioutil.ReadAll(errorStream)
+		if err == nil && len(message) > 0 {
+			err = errors.New(string(message))
+		}
+		errorCh <- err
+	}()
+	headers.Set(v1.StreamType, v1.StreamTypeData)
+	dataStream, err := streamConn.CreateStream(headers)
+	if err != nil {
+		return err
+	}
+	remoteDone := make(chan struct{})
+	localDone := make(chan struct{})
+	go func() {
+		io.Copy(conn, dataStream)
+		close(remoteDone)
+	}()
+	go func() {
+		io.Copy(dataStream, conn)
+		dataStream.Close()
+		close(localDone)
+	}()
+	select {
+	case <-localDone:
+		// WebSocket无法半关闭，客户端断开后不再等待远端数据
+		return nil
+	case <-remoteDone:
+	case <-ctx.Done():
+		return nil
+	}
+	// 远端关闭后error流中可能有端口未监听等错误信息
+	err = <-errorCh
+	if err != nil {
+		log.Errorf("Port forward error:%s; Pod:%s; Port:%d", err, pod.Name, port)
+	}
+	return err
+}
+
+// 按照端口号或者端口名称查找Service端口，只有一个端口时可以不指定
+func findServicePort(svc *v1.Service, port string) (*v1.ServicePort, error) {
+	if port == "" && len(svc.Spec.Ports) == 1 {
+		return &svc.Spec.Ports[0], nil
+	}
+	for i, p := range svc.Spec.Ports {
+		if p.Name == port || strconv.Itoa(int(p.Port)) == port {
+			return &svc.Spec.Ports[i], nil
+		}
+	}
+	return nil, fmt.Errorf("service %s has no port %s", svc.Name, port)
+}
+
+// 端口名称需要转换成容器中定义的端口号
+func containerPort(pod *v1.Pod, port intstr.IntOrString) (int32, error) {
+	if port.Type == intstr.Int {
+		if port.IntVal <= 0 || port.IntVal > 65535 {
+			return 0, fmt.Errorf("invalid port %d", port.IntVal)
+		}
+		return port.IntVal, nil
+	}
+	for _, container := range pod.Spec.Containers {
+		for _, p := range container.Ports {
+			if p.Name == port.StrVal && p.Protocol != v1.ProtocolUDP {
+				return p.ContainerPort, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("pod %s has no port named %s", pod.Name, port.StrVal)
+}
+
+func podReady(pod *v1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
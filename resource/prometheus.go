@@ -7,6 +7,7 @@ import (
 	"github.com/open-kingfisher/king-utils/common/handle"
 	"github.com/open-kingfisher/king-utils/common/log"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"regexp"
 	"time"
@@ -80,3 +81,28 @@ func (r *PrometheusResource) getMem() interface{} {
 
 	return string(s[1]) // s[0]全部内容，是s[1]括号中的内容
 }
+
+// 查询结果为单个数值，向量结果取第一个样本
+func (r *PrometheusResource) QueryValue(query string) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, warnings, err := r.ClientSet.Query(ctx, query, time.Now())
+	if err != nil {
+		log.Errorf("Error querying Prometheus: %v", err)
+		return 0, err
+	}
+	if len(warnings) > 0 {
+		log.Errorf("Warnings: %v", warnings)
+	}
+	switch v := result.(type) {
+	case *model.Scalar:
+		return float64(v.Value), nil
+	case model.Vector:
+		if len(v) == 0 {
+			return 0, fmt.Errorf("query %s returned no data", query)
+		}
+		return float64(v[0].Value), nil
+	default:
+		return 0, fmt.Errorf("query %s returned unsupported type %s", query, result.Type())
+	}
+}
@@ -0,0 +1,530 @@
+package resource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"github.com/open-kingfisher/king-utils/db"
+	"github.com/open-kingfisher/king-utils/kit"
+	"github.com/open-kingfisher/king-utils/middleware/jwt"
+	"k8s.io/api/apps/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RolloutTable = "rollout"
+	RolloutList  = common.ActionType("rollout_list")
+	RolloutGet   = common.ActionType("rollout_get")
+	RolloutAbort = common.ActionType("rollout_abort")
+	// 上线过程中创建的对象带有上线记录的Id
+	RolloutAnnotation = "kingfisher.io/rollout"
+	// 分步上线的状态，pending表示记录已经创建但镜像还未更新
+	RolloutPending     = "pending"
+	RolloutProgressing = "progressing"
+	RolloutPaused      = "paused"
+	RolloutCompleted   = "completed"
+	RolloutFailed      = "failed"
+	RolloutAborted     = "aborted"
+)
+
+// 接口和RolloutReconciler都会修改上线记录，同一进程内串行执行，多个副本之间通过Version检查并发修改
+var rolloutLock sync.Mutex
+
+var errRolloutConflict = errors.New("rollout was modified by another request, please retry")
+
+type RolloutEvent struct {
+	Time    int64  `json:"time"`
+	State   string `json:"state"`
+	Step    int32  `json:"step"`
+	Message string `json:"message"`
+}
+
+// 分步上线记录，保存在数据库中，服务重启后由RolloutReconciler继续跟踪
+type RolloutDB struct {
+	Id        string             `json:"id"`
+	Cluster   string             `json:"cluster"`
+	Namespace string             `json:"namespace"`
+	Kind      string             `json:"kind"`
+	Name      string             `json:"name"`
+	User      string             `json:"user"`
+	Patches   []common.PatchData `json:"patches"`
+	// 上线方式，为空时按步长分组上线，canary为金丝雀发布
+	Strategy  string           `json:"strategy"`
+	Canary    *CanaryConfig    `json:"canary,omitempty"`
+	BlueGreen *BlueGreenConfig `json:"blueGreen,omitempty"`
+	// 步长，整数或者百分比，StepSize为换算后每一步更新的副本数
+	Step        string `json:"step"`
+	StepSize    int32  `json:"stepSize"`
+	Replicas    int32  `json:"replicas"`
+	CurrentStep int32  `json:"currentStep"`
+	TotalSteps  int32  `json:"totalSteps"`
+	// 剩余的分组不再暂停，自动上线
+	Auto bool `json:"auto"`
+	// DaemonSet按此节点标签的值分组删除旧Pod
+	NodeGroup string `json:"nodeGroup"`
+	// StatefulSet和DaemonSet上线前的更新策略，上线结束后恢复
+	UpdateStrategy json.RawMessage `json:"updateStrategy,omitempty"`
+	// 上线前的版本，终止上线时回滚到此版本
+	FromRevision    int64          `json:"fromRevision"`
+	State           string         `json:"state"`
+	Message         string         `json:"message"`
+	UpdatedReplicas int32          `json:"updatedReplicas"`
+	PodIP           []string       `json:"podIP"`
+	History         []RolloutEvent `json:"history"`
+	CreateTime      int64          `json:"createTime"`
+	ModifyTime      int64          `json:"modifyTime"`
+	// 每次保存加1，只有数据库中的版本与读取时相同才能保存成功
+	Version int64 `json:"version"`
+}
+
+// 当前步骤需要达到的更新副本数
+func (rollout *RolloutDB) target() int32 {
+	if rollout.Auto || rollout.CurrentStep >= rollout.TotalSteps {
+		return rollout.Replicas
+	}
+	return rollout.CurrentStep * rollout.StepSize
+}
+
+func (rollout *RolloutDB) transition(state, message string) {
+	now := time.Now().Unix()
+	rollout.State = state
+	rollout.Message = message
+	rollout.ModifyTime = now
+	rollout.History = append(rollout.History, RolloutEvent{Time: now, State: state, Step: rollout.CurrentStep, Message: message})
+	log.Infof("Rollout %s %s/%s step %d/%d %s: %s", rollout.Id, rollout.Namespace, rollout.Name, rollout.CurrentStep, rollout.TotalSteps, state, message)
+}
+
+// 副本数变化时重新计算步长和总步数
+func (rollout *RolloutDB) setReplicas(replicas int32) error {
+	var stepSize int32
+	if strings.Contains(rollout.Step, "%") {
+		v, err := strconv.Atoi(strings.TrimRight(rollout.Step, "%"))
+		if err != nil {
+			return err
+		}
+		stepSize = int32(math.Floor(float64(v) * float64(replicas) / 100))
+	} else {
+		v, err := strconv.Atoi(rollout.Step)
+		if err != nil {
+			return err
+		}
+		stepSize = int32(v)
+	}
+	if stepSize < 1 {
+		stepSize = 1
+	}
+	rollout.Replicas = replicas
+	rollout.StepSize = stepSize
+	rollout.TotalSteps = int32(math.Ceil(float64(replicas) / float64(stepSize)))
+	if rollout.TotalSteps < 1 {
+		rollout.TotalSteps = 1
+	}
+	return nil
+}
+
+func (rollout *RolloutDB) active() bool {
+	return rollout.State == RolloutPending || rollout.State == RolloutProgressing || rollout.State == RolloutPaused
+}
+
+func saveRollout(rollout *RolloutDB) error {
+	version := rollout.Version
+	rollout.Version++
+	data, err := json.Marshal(rollout)
+	if err != nil {
+		rollout.Version = version
+		return err
+	}
+	// 旧的记录没有version字段，按0处理
+	result, err := db.DB.Exec("UPDATE "+RolloutTable+" SET data=CAST(? AS JSON) WHERE data->'$.id'=? AND COALESCE(data->'$.version', 0)=?",
+		string(data), rollout.Id, version)
+	if err == nil {
+		var rows int64
+		if rows, err = result.RowsAffected(); err == nil && rows == 0 {
+			err = errRolloutConflict
+		}
+	}
+	if err != nil {
+		rollout.Version = version
+		log.Errorf("Rollout update error:%s; Id:%s", err, rollout.Id)
+		return err
+	}
+	return nil
+}
+
+// 控制器的分步上线记录，按创建时间倒序
+func (r *ControllerResource) ListRollout() ([]*RolloutDB, error) {
+	rollouts := make([]*RolloutDB, 0)
+	clause := "WHERE data->'$.cluster'=? AND data->'$.namespace'=? AND data->'$.kind'=? AND data->'$.name'=? ORDER BY data->'$.createTime' DESC"
+	if err := db.List(common.DataField, RolloutTable, &rollouts, clause, r.Params.Cluster, r.Params.Namespace, r.Params.Controller, r.Params.Name); err != nil {
+		return nil, err
+	}
+	return rollouts, nil
+}
+
+func (r *ControllerResource) GetRollout(id string) (*RolloutDB, error) {
+	rollout := &RolloutDB{}
+	if err := db.GetById(RolloutTable, id, rollout); err != nil {
+		return nil, err
+	}
+	if rollout.Cluster != r.Params.Cluster || rollout.Namespace != r.Params.Namespace || rollout.Name != r.Params.Name {
+		return nil, errors.New("rollout not found")
+	}
+	return rollout, nil
+}
+
+// 正在进行中的分步上线，没有时返回nil
+func (r *ControllerResource) activeRollout() (*RolloutDB, error) {
+	rollouts, err := r.ListRollout()
+	if err != nil {
+		return nil, err
+	}
+	for _, rollout := range rollouts {
+		if rollout.active() {
+			return rollout, nil
+		}
+	}
+	return nil, nil
+}
+
+// 创建分步上线记录，记录保存成功后才更新镜像
+func (r *ControllerResource) startRollout(replicas int32, fromRevision int64, patches []common.PatchData) (*RolloutDB, error) {
+	rollout := r.newRollout(fromRevision, patches)
+	rollout.Step = r.Params.Step
+	if err := rollout.setReplicas(replicas); err != nil {
+		return nil, err
+	}
+	if err := r.createRollout(rollout); err != nil {
+		return nil, err
+	}
+	return rollout, nil
+}
+
+func (r *ControllerResource) newRollout(fromRevision int64, patches []common.PatchData) *RolloutDB {
+	var user string
+	if r.Params.User != nil {
+		user = r.Params.User.Name
+	}
+	return &RolloutDB{
+		Id:           kit.UUID("o"),
+		Cluster:      r.Params.Cluster,
+		Namespace:    r.Params.Namespace,
+		Kind:         r.Params.Controller,
+		Name:         r.Params.Name,
+		User:         user,
+		Patches:      patches,
+		CurrentStep:  1,
+		FromRevision: fromRevision,
+		PodIP:        make([]string, 0),
+		CreateTime:   time.Now().Unix(),
+	}
+}
+
+func deploymentRevision(deployment *v1.Deployment) int64 {
+	revision, _ := strconv.ParseInt(deployment.Annotations[DeploymentRevision], 10, 64)
+	return revision
+}
+
+// 同一个控制器同时只能有一个进行中的上线
+func (r *ControllerResource) createRollout(rollout *RolloutDB) error {
+	if active, err := r.activeRollout(); err != nil {
+		return err
+	} else if active != nil {
+		return fmt.Errorf("rollout %s is %s, finish or abort it first", active.Id, active.State)
+	}
+	rollout.transition(RolloutPending, "rollout created")
+	data, err := json.Marshal(rollout)
+	if err != nil {
+		return err
+	}
+	// 其他副本可能同时创建上线记录，插入时再检查一次
+	result, err := db.DB.Exec("INSERT INTO "+RolloutTable+" (data) SELECT CAST(? AS JSON) FROM DUAL WHERE NOT EXISTS ("+
+		"SELECT 1 FROM "+RolloutTable+" WHERE data->'$.cluster'=? AND data->'$.namespace'=? AND data->'$.kind'=? AND data->'$.name'=? "+
+		"AND (data->'$.state'=? OR data->'$.state'=? OR data->'$.state'=?))",
+		string(data), rollout.Cluster, rollout.Namespace, rollout.Kind, rollout.Name, RolloutPending, RolloutProgressing, RolloutPaused)
+	if err != nil {
+		log.Errorf("Rollout insert error:%s; Id:%s", err, rollout.Id)
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return errors.New("another rollout was created at the same time, finish or abort it first")
+	}
+	return nil
+}
+
+// 终止分步上线，恢复控制器并回滚到上线前的版本
+func (r *ControllerResource) AbortRollout() (*RolloutDB, error) {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+	rollout, err := r.activeRollout()
+	if err != nil {
+		return nil, err
+	}
+	if rollout == nil {
+		return nil, errors.New("no rollout in progress")
+	}
+	message := "aborted by " + r.Params.User.Name
+	if rollout.Strategy == RolloutBlueGreen {
+		// 切换回旧版本并删除新版本
+		if err := r.rollbackBlueGreen(rollout); err != nil {
+			return nil, err
+		}
+		message = message + ", traffic switched back to " + rollout.BlueGreen.ActiveName
+	} else if rollout.Strategy == RolloutCanary && rollout.Canary.Phase != CanaryPhasePromoting {
+		// 稳定版本还未修改，删除金丝雀即可
+		if err := r.rollbackCanary(rollout); err != nil {
+			return nil, err
+		}
+		message = message + ", canary rolled back"
+	} else if err := r.rollbackRollout(rollout); err != nil {
+		message = fmt.Sprintf("%s, rollback to revision %d failed: %s", message, rollout.FromRevision, err)
+	} else if rollout.FromRevision > 0 {
+		message = fmt.Sprintf("%s, rollback to revision %d", message, rollout.FromRevision)
+	}
+	if rollout.Strategy == RolloutCanary && rollout.Canary.Phase == CanaryPhasePromoting {
+		// 全量过程中中止，稳定版本回滚后同样删除金丝雀Deployment以及istio路由
+		if err := r.deleteCanary(rollout); err != nil {
+			message = fmt.Sprintf("%s, canary cleanup failed: %s", message, err)
+		}
+	}
+	rollout.transition(RolloutAborted, message)
+	if err := saveRollout(rollout); err != nil {
+		return nil, err
+	}
+	kind, _ := rolloutKind(rollout.Kind)
+	auditLog := handle.AuditLog{
+		Kind:       kind,
+		ActionType: RolloutAbort,
+		Resources:  r.Params,
+		Name:       r.Params.Name,
+		PostData:   map[string]interface{}{"rollout": rollout.Id, "step": rollout.CurrentStep},
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return nil, err
+	}
+	return rollout, nil
+}
+
+// 定期检查所有进行中的分步上线，服务重启或者watch中断后依然可以继续跟踪，暂停的上线只做健康检查
+func RolloutReconciler(interval time.Duration) {
+	for range time.Tick(interval) {
+		rollouts := make([]*RolloutDB, 0)
+		clause := "WHERE data->'$.state'=? OR data->'$.state'=? OR data->'$.state'=?"
+		if err := db.List(common.DataField, RolloutTable, &rollouts, clause, RolloutPending, RolloutProgressing, RolloutPaused); err != nil {
+			log.Errorf("Rollout reconciler list error: %s", err)
+			continue
+		}
+		for _, rollout := range rollouts {
+			if err := reconcileRollout(rollout); err != nil {
+				log.Errorf("Rollout %s reconcile error: %s", rollout.Id, err)
+			}
+		}
+	}
+}
+
+func reconcileRollout(rollout *RolloutDB) error {
+	rolloutLock.Lock()
+	defer rolloutLock.Unlock()
+	// 重新读取，避免覆盖接口刚刚做的修改
+	if err := db.GetById(RolloutTable, rollout.Id, rollout); err != nil {
+		return err
+	}
+	if !rollout.active() {
+		return nil
+	}
+	clientSet, err := access.Access(rollout.Cluster)
+	if err != nil {
+		return err
+	}
+	r := &ControllerResource{Params: &handle.Resources{
+		Cluster:    rollout.Cluster,
+		Namespace:  rollout.Namespace,
+		Name:       rollout.Name,
+		Controller: rollout.Kind,
+		ClientSet:  clientSet,
+		// 后台操作记录在发起上线的用户名下
+		User: &jwt.CustomClaims{Name: rollout.User},
+	}}
+	if rollout.State == RolloutPaused {
+		return checkPausedRollout(r, rollout)
+	}
+	if rollout.Strategy == RolloutBlueGreen {
+		return reconcileBlueGreen(r, rollout)
+	}
+	if rollout.Kind != "deployment" {
+		return reconcileWorkloadRollout(r, rollout)
+	}
+	deployment, err := r.assertDeployment()
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			rollout.transition(RolloutFailed, "deployment not found")
+			return saveRollout(rollout)
+		}
+		return err
+	}
+	if rollout.Strategy == RolloutCanary {
+		return reconcileCanary(r, rollout, deployment)
+	}
+	if rollout.State == RolloutPending {
+		// 创建记录后服务中断，镜像可能还未更新，重新应用一次
+		if err := r.applyRolloutPatch(rollout); err != nil {
+			return err
+		}
+		rollout.transition(RolloutProgressing, fmt.Sprintf("step %d/%d started", rollout.CurrentStep, rollout.TotalSteps))
+		return saveRollout(rollout)
+	}
+	if err := rollout.setReplicas(*deployment.Spec.Replicas); err != nil {
+		return err
+	}
+	status := deployment.Status
+	rollout.UpdatedReplicas = status.UpdatedReplicas
+	rollout.ModifyTime = time.Now().Unix()
+	// 新版本Pod不健康或者超过进度期限时自动回滚
+	if reason, err := r.rolloutHealth(deployment); err != nil {
+		return err
+	} else if reason != "" {
+		return r.autoRollback(rollout, reason)
+	}
+	target := rollout.target()
+	// 步骤边界由watch及时暂停，这里在watch中断或者服务重启后兜底，最后一步不需要暂停
+	if target < rollout.Replicas && !deployment.Spec.Paused {
+		if stepReached(deployment, target) {
+			if err := setDeploymentPaused(r, true); err != nil {
+				return err
+			}
+		} else {
+			watchRolloutStep(r, rollout)
+		}
+	}
+	// 更新的Pod全部可用后当前步骤才算完成
+	if deployment.Generation > status.ObservedGeneration || status.UpdatedReplicas < target || status.UnavailableReplicas > 0 {
+		return saveRollout(rollout)
+	}
+	if uid, err := r.getLatestReplica(string(deployment.UID)); err == nil {
+		if podIP, err := r.getLatestReplicaPodIp(uid); err == nil {
+			rollout.PodIP = podIP
+		}
+	}
+	if target < rollout.Replicas {
+		rollout.transition(RolloutPaused, fmt.Sprintf("step %d/%d completed, %d/%d replicas updated", rollout.CurrentStep, rollout.TotalSteps, status.UpdatedReplicas, rollout.Replicas))
+		return saveRollout(rollout)
+	}
+	if status.Replicas == rollout.Replicas && status.AvailableReplicas == rollout.Replicas {
+		if deployment.Spec.Paused {
+			if err := setDeploymentPaused(r, false); err != nil {
+				return err
+			}
+		}
+		rollout.CurrentStep = rollout.TotalSteps
+		rollout.transition(RolloutCompleted, fmt.Sprintf("%d/%d replicas updated", status.UpdatedReplicas, rollout.Replicas))
+	}
+	return saveRollout(rollout)
+}
+
+// 恢复Deployment并更新镜像以及最大不可达数，JSON patch重复应用结果相同
+func (r *ControllerResource) applyRolloutPatch(rollout *RolloutDB) error {
+	patches := append([]common.PatchData{{Op: "add", Path: "/spec/paused", Value: false}}, rollout.Patches...)
+	data, err := json.Marshal(patches)
+	if err != nil {
+		return err
+	}
+	_, err = r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Patch(r.Params.Name, types.JSONPatchType, data)
+	return err
+}
+
+// 当前版本的更新副本数达到步骤边界
+func stepReached(deployment *v1.Deployment, target int32) bool {
+	return deployment.Generation <= deployment.Status.ObservedGeneration && deployment.Status.UpdatedReplicas >= target
+}
+
+// 每个上线记录的步骤watch，只保留最新步骤的watch
+type rolloutStepWatch struct {
+	target int32
+	stop   chan struct{}
+}
+
+var (
+	rolloutWatchLock sync.Mutex
+	rolloutWatches   = make(map[string]*rolloutStepWatch)
+)
+
+// watch Deployment，更新副本数达到当前步骤边界时立即暂停，避免轮询间隔内越过多个步骤
+func watchRolloutStep(r *ControllerResource, rollout *RolloutDB) {
+	target := rollout.target()
+	if rollout.Kind != "deployment" || rollout.Strategy != "" || target >= rollout.Replicas {
+		return
+	}
+	rolloutWatchLock.Lock()
+	if current, ok := rolloutWatches[rollout.Id]; ok {
+		if current.target == target {
+			rolloutWatchLock.Unlock()
+			return
+		}
+		close(current.stop)
+	}
+	stepWatch := &rolloutStepWatch{target: target, stop: make(chan struct{})}
+	rolloutWatches[rollout.Id] = stepWatch
+	rolloutWatchLock.Unlock()
+	go func() {
+		defer func() {
+			rolloutWatchLock.Lock()
+			if rolloutWatches[rollout.Id] == stepWatch {
+				delete(rolloutWatches, rollout.Id)
+			}
+			rolloutWatchLock.Unlock()
+		}()
+		watcher, err := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Watch(metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("metadata.name", r.Params.Name).String(),
+		})
+		if err != nil {
+			log.Errorf("Rollout %s watch error: %s", rollout.Id, err)
+			return
+		}
+		defer watcher.Stop()
+		for {
+			select {
+			case <-stepWatch.stop:
+				return
+			case event, ok := <-watcher.ResultChan():
+				if !ok {
+					return
+				}
+				deployment, ok := event.Object.(*v1.Deployment)
+				if !ok || event.Type == watch.Deleted || deployment.Spec.Paused {
+					return
+				}
+				if stepReached(deployment, target) {
+					setDeploymentPaused(r, true)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// 后台修改暂停状态，没有用户信息，不使用Patch记录审计日志
+func setDeploymentPaused(r *ControllerResource, paused bool) error {
+	data, err := json.Marshal([]common.PatchData{{Op: "add", Path: "/spec/paused", Value: paused}})
+	if err != nil {
+		return err
+	}
+	if _, err := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Patch(r.Params.Name, types.JSONPatchType, data); err != nil {
+		log.Errorf("Deployment patch paused error:%s; Paused:%t; Name:%s", err, paused, r.Params.Name)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package resource
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/open-kingfisher/king-k8s/util"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"github.com/open-kingfisher/king-utils/common/rabbitmq"
+	"github.com/open-kingfisher/king-utils/config"
+	"k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
+)
+
+const (
+	RolloutAutoRollback = common.ActionType("rollout_auto_rollback")
+	// 上线失败的通知发送到此exchange，消息内容为上线记录
+	RolloutNotifyExchange = "kingfisher.rollout"
+)
+
+// 健康检查的阈值，可以通过启动参数修改
+var (
+	RolloutAutoRollbackEnabled = true
+	RolloutMaxRestarts         = 3
+	RolloutReadinessTimeout    = 5 * time.Minute
+)
+
+// 这些原因的容器不会自己恢复，直接判定上线失败
+var rolloutFatalReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+type RolloutNotification struct {
+	Reason  string     `json:"reason"`
+	Rollout *RolloutDB `json:"rollout"`
+}
+
+// 检查最新ReplicaSet的Pod，返回不健康的原因，健康时返回空字符串
+func (r *ControllerResource) rolloutHealth(deployment *v1.Deployment) (string, error) {
+	if deploymentFailed(deployment) {
+		return "progress deadline exceeded", nil
+	}
+	uid, err := r.getLatestReplica(string(deployment.UID))
+	if err != nil || uid == "" {
+		return "", err
+	}
+	pods, err := util.GetPodBySelectorLabel(util.GenerateLabelSelector(deployment.Spec.Selector.MatchLabels), r.Params.Namespace, r.Params.ClientSet)
+	if err != nil {
+		return "", err
+	}
+	owned := make([]corev1.Pod, 0)
+	for _, pod := range pods.Items {
+		if isOwnedBy(pod.OwnerReferences, uid) {
+			owned = append(owned, pod)
+		}
+	}
+	return podsHealth(owned), nil
+}
+
+// 暂停的上线不推进步骤，只检查已经更新的Pod，不健康时同样回滚
+func checkPausedRollout(r *ControllerResource, rollout *RolloutDB) error {
+	var reason string
+	switch {
+	case rollout.Strategy == RolloutCanary:
+		canary, err := r.Params.ClientSet.AppsV1().Deployments(r.Params.Namespace).Get(r.Params.Name+CanarySuffix, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if reason, err = r.rolloutHealth(canary); err != nil {
+			return err
+		} else if reason != "" {
+			return failCanary(r, rollout, "canary "+reason)
+		}
+		return nil
+	case rollout.Kind == "deployment":
+		deployment, err := r.assertDeployment()
+		if err != nil {
+			return err
+		}
+		if reason, err = r.rolloutHealth(deployment); err != nil {
+			return err
+		}
+	default:
+		object, err := r.Get()
+		if err != nil {
+			return err
+		}
+		pods, err := r.updatedWorkloadPods(object)
+		if err != nil {
+			return err
+		}
+		reason = podsHealth(pods)
+	}
+	if reason != "" {
+		return r.autoRollback(rollout, reason)
+	}
+	return nil
+}
+
+// 检查新版本的Pod，返回不健康的原因
+func podsHealth(pods []corev1.Pod) string {
+	for _, pod := range pods {
+		statuses := make([]corev1.ContainerStatus, 0, len(pod.Status.InitContainerStatuses)+len(pod.Status.ContainerStatuses))
+		statuses = append(statuses, pod.Status.InitContainerStatuses...)
+		statuses = append(statuses, pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if status.State.Waiting != nil && rolloutFatalReasons[status.State.Waiting.Reason] {
+				return fmt.Sprintf("pod %s container %s %s", pod.Name, status.Name, status.State.Waiting.Reason)
+			}
+			if RolloutMaxRestarts > 0 && status.RestartCount >= int32(RolloutMaxRestarts) {
+				return fmt.Sprintf("pod %s container %s restarted %d times", pod.Name, status.Name, status.RestartCount)
+			}
+		}
+		if pod.Status.Phase != corev1.PodRunning || RolloutReadinessTimeout <= 0 {
+			continue
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady && condition.Status != corev1.ConditionTrue &&
+				time.Since(condition.LastTransitionTime.Time) > RolloutReadinessTimeout {
+				return fmt.Sprintf("pod %s not ready for %s", pod.Name, RolloutReadinessTimeout)
+			}
+		}
+	}
+	return ""
+}
+
+// 停止更新，回滚到上线前的版本，记录审计日志并发送通知
+func (r *ControllerResource) autoRollback(rollout *RolloutDB, reason string) error {
+	if err := haltRollout(r, rollout); err != nil {
+		return err
+	}
+	message := reason
+	if !RolloutAutoRollbackEnabled || rollout.FromRevision == 0 {
+		message = message + ", rollout halted"
+	} else if err := r.rollbackRollout(rollout); err != nil {
+		haltRollout(r, rollout)
+		message = fmt.Sprintf("%s, rollout halted, rollback failed: %s", message, err)
+	} else {
+		message = fmt.Sprintf("%s, rolled back to revision %d", message, rollout.FromRevision)
+	}
+	rollout.transition(RolloutFailed, message)
+	if err := saveRollout(rollout); err != nil {
+		return err
+	}
+	kind, _ := rolloutKind(rollout.Kind)
+	auditLog := handle.AuditLog{
+		Kind:       kind,
+		ActionType: RolloutAutoRollback,
+		Resources:  r.Params,
+		Name:       r.Params.Name,
+		PostData:   map[string]interface{}{"rollout": rollout.Id, "reason": reason, "revision": rollout.FromRevision},
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		log.Errorf("Rollout %s audit log error: %s", rollout.Id, err)
+	}
+	notifyRollout(r, rollout, message)
+	return nil
+}
+
+// 上线失败时在控制器上记录Warning事件，同时通过消息队列通知
+func notifyRollout(r *ControllerResource, rollout *RolloutDB, message string) {
+	_, kind := rolloutKind(rollout.Kind)
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: r.Params.Name + ".",
+			Namespace:    r.Params.Namespace,
+			Annotations:  map[string]string{RolloutAnnotation: rollout.Id},
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "apps/v1",
+			Kind:       kind,
+			Namespace:  r.Params.Namespace,
+			Name:       r.Params.Name,
+		},
+		Reason:         "RolloutFailed",
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: "kingfisher"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := r.Params.ClientSet.CoreV1().Events(r.Params.Namespace).Create(event); err != nil {
+		log.Errorf("Rollout %s event create error: %s", rollout.Id, err)
+	}
+	body, err := json.Marshal(RolloutNotification{Reason: message, Rollout: rollout})
+	if err != nil {
+		return
+	}
+	if err := rabbitmq.ProducerPublish(config.RabbitMQURL, RolloutNotifyExchange, body); err != nil {
+		log.Errorf("Rollout %s notify error: %s", rollout.Id, err)
+	}
+}
+
+func isOwnedBy(owners []metav1.OwnerReference, uid string) bool {
+	for _, owner := range owners {
+		if string(owner.UID) == uid {
+			return true
+		}
+	}
+	return false
+}
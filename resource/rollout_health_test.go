@@ -0,0 +1,112 @@
+package resource
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPodsHealth(t *testing.T) {
+	maxRestarts, readinessTimeout := RolloutMaxRestarts, RolloutReadinessTimeout
+	defer func() {
+		RolloutMaxRestarts, RolloutReadinessTimeout = maxRestarts, readinessTimeout
+	}()
+	RolloutMaxRestarts = 3
+	RolloutReadinessTimeout = 5 * time.Minute
+
+	waiting := func(reason string) corev1.ContainerState {
+		return corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}}
+	}
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	ready := func(status corev1.ConditionStatus, since time.Duration) []corev1.PodCondition {
+		return []corev1.PodCondition{{
+			Type:               corev1.PodReady,
+			Status:             status,
+			LastTransitionTime: metav1.NewTime(time.Now().Add(-since)),
+		}}
+	}
+	tests := []struct {
+		name   string
+		status corev1.PodStatus
+		want   string
+	}{
+		{"healthy", corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", State: running}},
+			Conditions:        ready(corev1.ConditionTrue, time.Hour),
+		}, ""},
+		{"pending", corev1.PodStatus{
+			Phase:             corev1.PodPending,
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", State: waiting("ContainerCreating")}},
+		}, ""},
+		{"crash loop", corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", State: waiting("CrashLoopBackOff")}},
+		}, "container app CrashLoopBackOff"},
+		{"init image pull", corev1.PodStatus{
+			Phase:                 corev1.PodPending,
+			InitContainerStatuses: []corev1.ContainerStatus{{Name: "init", State: waiting("ImagePullBackOff")}},
+		}, "container init ImagePullBackOff"},
+		{"restarts", corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", State: running, RestartCount: 3}},
+			Conditions:        ready(corev1.ConditionTrue, time.Minute),
+		}, "container app restarted 3 times"},
+		{"not ready", corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", State: running}},
+			Conditions:        ready(corev1.ConditionFalse, 10*time.Minute),
+		}, "not ready for 5m0s"},
+		{"recently not ready", corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", State: running}},
+			Conditions:        ready(corev1.ConditionFalse, time.Minute),
+		}, ""},
+	}
+	for _, test := range tests {
+		pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "nginx-1"}, Status: test.status}
+		got := podsHealth([]corev1.Pod{pod})
+		if (test.want == "") != (got == "") || !strings.Contains(got, test.want) {
+			t.Errorf("%s: podsHealth() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// 阈值为0时不检查重启次数和就绪时间
+func TestPodsHealthDisabled(t *testing.T) {
+	maxRestarts, readinessTimeout := RolloutMaxRestarts, RolloutReadinessTimeout
+	defer func() {
+		RolloutMaxRestarts, RolloutReadinessTimeout = maxRestarts, readinessTimeout
+	}()
+	RolloutMaxRestarts = 0
+	RolloutReadinessTimeout = 0
+	pod := corev1.Pod{Status: corev1.PodStatus{
+		Phase:             corev1.PodRunning,
+		ContainerStatuses: []corev1.ContainerStatus{{Name: "app", RestartCount: 100}},
+		Conditions: []corev1.PodCondition{{
+			Type:               corev1.PodReady,
+			Status:             corev1.ConditionFalse,
+			LastTransitionTime: metav1.NewTime(time.Now().Add(-time.Hour)),
+		}},
+	}}
+	if got := podsHealth([]corev1.Pod{pod}); got != "" {
+		t.Errorf("podsHealth() = %q, want empty", got)
+	}
+}
+
+// 合并容器状态时不能写入Pod的底层数组，Pod可能来自缓存
+func TestPodsHealthDoesNotModifyPod(t *testing.T) {
+	initStatuses := make([]corev1.ContainerStatus, 1, 2)
+	initStatuses[0] = corev1.ContainerStatus{Name: "init"}
+	pod := corev1.Pod{Status: corev1.PodStatus{
+		Phase:                 corev1.PodPending,
+		InitContainerStatuses: initStatuses,
+		ContainerStatuses:     []corev1.ContainerStatus{{Name: "app"}},
+	}}
+	podsHealth([]corev1.Pod{pod})
+	if name := initStatuses[:2][1].Name; name != "" {
+		t.Errorf("podsHealth wrote container status %q into the pod's init container statuses", name)
+	}
+}
@@ -0,0 +1,91 @@
+package resource
+
+import (
+	"k8s.io/api/apps/v1"
+	"testing"
+)
+
+func TestRolloutSetReplicas(t *testing.T) {
+	tests := []struct {
+		step       string
+		replicas   int32
+		stepSize   int32
+		totalSteps int32
+		wantErr    bool
+	}{
+		{"2", 10, 2, 5, false},
+		{"3", 10, 3, 4, false},
+		{"25%", 10, 2, 5, false},
+		{"50%", 5, 2, 3, false},
+		// 百分比换算后不足1时每一步更新1个
+		{"1%", 10, 1, 10, false},
+		{"10", 3, 10, 1, false},
+		{"0", 0, 1, 1, false},
+		{"a", 10, 0, 0, true},
+		{"a%", 10, 0, 0, true},
+	}
+	for _, test := range tests {
+		rollout := &RolloutDB{Step: test.step}
+		err := rollout.setReplicas(test.replicas)
+		if (err != nil) != test.wantErr {
+			t.Errorf("setReplicas(%q, %d) error = %v, wantErr %v", test.step, test.replicas, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if rollout.StepSize != test.stepSize || rollout.TotalSteps != test.totalSteps {
+			t.Errorf("setReplicas(%q, %d) = step size %d, total steps %d, want %d, %d",
+				test.step, test.replicas, rollout.StepSize, rollout.TotalSteps, test.stepSize, test.totalSteps)
+		}
+	}
+}
+
+func TestRolloutTarget(t *testing.T) {
+	tests := []struct {
+		currentStep int32
+		auto        bool
+		want        int32
+	}{
+		{1, false, 3},
+		{3, false, 9},
+		// 最后一步更新所有副本
+		{4, false, 10},
+		{5, false, 10},
+		{1, true, 10},
+	}
+	for _, test := range tests {
+		rollout := &RolloutDB{Step: "3", CurrentStep: test.currentStep, Auto: test.auto}
+		if err := rollout.setReplicas(10); err != nil {
+			t.Fatal(err)
+		}
+		if got := rollout.target(); got != test.want {
+			t.Errorf("target() at step %d auto %v = %d, want %d", test.currentStep, test.auto, got, test.want)
+		}
+	}
+}
+
+func TestStepReached(t *testing.T) {
+	tests := []struct {
+		name               string
+		generation         int64
+		observedGeneration int64
+		updatedReplicas    int32
+		want               bool
+	}{
+		{"reached", 2, 2, 3, true},
+		{"overshot", 2, 2, 5, true},
+		{"not reached", 2, 2, 2, false},
+		// 控制器还未处理新的模板时，更新副本数是旧版本的
+		{"not observed", 3, 2, 10, false},
+	}
+	for _, test := range tests {
+		deployment := &v1.Deployment{}
+		deployment.Generation = test.generation
+		deployment.Status.ObservedGeneration = test.observedGeneration
+		deployment.Status.UpdatedReplicas = test.updatedReplicas
+		if got := stepReached(deployment, 3); got != test.want {
+			t.Errorf("%s: stepReached() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
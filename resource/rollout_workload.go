@@ -0,0 +1,447 @@
+package resource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-k8s/util"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sort"
+	"time"
+)
+
+// StatefulSet通过partition分步上线，序号大于等于partition的Pod会被更新
+// DaemonSet切换为OnDelete，由RolloutReconciler按节点分组删除旧Pod，上线结束后恢复原来的更新策略
+
+// StatefulSet和DaemonSet的首次上线，镜像和更新策略一起修改
+func (r *ControllerResource) startWorkloadRollout() (interface{}, error) {
+	object, err := r.Get()
+	if err != nil {
+		return nil, err
+	}
+	var replicas int32
+	var strategy interface{}
+	switch o := object.(type) {
+	case *v1.StatefulSet:
+		replicas, strategy = *o.Spec.Replicas, o.Spec.UpdateStrategy
+	case *v1.DaemonSet:
+		replicas, strategy = o.Status.DesiredNumberScheduled, o.Spec.UpdateStrategy
+	default:
+		return nil, errors.New("controller kind doesn't support stepped rollout")
+	}
+	updateStrategy, err := json.Marshal(strategy)
+	if err != nil {
+		return nil, err
+	}
+	revisions, err := r.listRevision()
+	if err != nil {
+		return nil, err
+	}
+	rollout := r.newRollout(0, r.Params.PatchData.Patches)
+	if current := findRevision(revisions, 0); current != nil {
+		rollout.FromRevision = current.Revision
+	}
+	rollout.Step = r.Params.Step
+	rollout.NodeGroup = r.NodeGroup
+	rollout.UpdateStrategy = updateStrategy
+	if err := rollout.setReplicas(replicas); err != nil {
+		return nil, err
+	}
+	if err := r.createRollout(rollout); err != nil {
+		return nil, err
+	}
+	r.Params.PatchData.Patches = append(r.workloadStrategyPatch(rollout), rollout.Patches...)
+	if _, err := r.Patch(); err != nil {
+		rollout.transition(RolloutFailed, err.Error())
+		saveRollout(rollout)
+		return nil, err
+	}
+	rollout.transition(RolloutProgressing, fmt.Sprintf("step %d/%d started by %s", rollout.CurrentStep, rollout.TotalSteps, r.Params.User.Name))
+	if err := saveRollout(rollout); err != nil {
+		return nil, err
+	}
+	return r.rolloutStatus(rollout)
+}
+
+// 当前步骤的更新策略，StatefulSet使用partition，DaemonSet使用OnDelete
+func (r *ControllerResource) workloadStrategyPatch(rollout *RolloutDB) []common.PatchData {
+	if rollout.Kind == "daemonset" {
+		return []common.PatchData{{Op: "replace", Path: "/spec/updateStrategy", Value: v1.DaemonSetUpdateStrategy{Type: v1.OnDeleteDaemonSetStrategyType}}}
+	}
+	partition := rollout.Replicas - rollout.target()
+	if partition < 0 {
+		partition = 0
+	}
+	return statefulSetPartitionPatch(partition)
+}
+
+func statefulSetPartitionPatch(partition int32) []common.PatchData {
+	return []common.PatchData{{Op: "replace", Path: "/spec/updateStrategy", Value: v1.StatefulSetUpdateStrategy{
+		Type:          v1.RollingUpdateStatefulSetStrategyType,
+		RollingUpdate: &v1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+	}}}
+}
+
+// 恢复上线前的更新策略
+func restoreWorkloadStrategy(r *ControllerResource, rollout *RolloutDB) error {
+	if len(rollout.UpdateStrategy) == 0 {
+		return nil
+	}
+	return patchWorkload(r, []common.PatchData{{Op: "replace", Path: "/spec/updateStrategy", Value: rollout.UpdateStrategy}})
+}
+
+// 后台修改StatefulSet和DaemonSet，没有用户信息，不使用Patch记录审计日志
+func patchWorkload(r *ControllerResource, patches []common.PatchData) error {
+	data, err := json.Marshal(patches)
+	if err != nil {
+		return err
+	}
+	switch r.Params.Controller {
+	case "statefulset":
+		_, err = r.Params.ClientSet.AppsV1().StatefulSets(r.Params.Namespace).Patch(r.Params.Name, types.JSONPatchType, data)
+	case "daemonset":
+		_, err = r.Params.ClientSet.AppsV1().DaemonSets(r.Params.Namespace).Patch(r.Params.Name, types.JSONPatchType, data)
+	default:
+		return errors.New("controller kind doesn't support stepped rollout")
+	}
+	if err != nil {
+		log.Errorf("%s patch error:%s; Json:%s; Name:%s", r.Params.Controller, err, string(data), r.Params.Name)
+	}
+	return err
+}
+
+func reconcileWorkloadRollout(r *ControllerResource, rollout *RolloutDB) error {
+	object, err := r.Get()
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			rollout.transition(RolloutFailed, rollout.Kind+" not found")
+			return saveRollout(rollout)
+		}
+		return err
+	}
+	if rollout.State == RolloutPending {
+		// 创建记录后服务中断，镜像可能还未更新，重新应用一次
+		if err := patchWorkload(r, append(r.workloadStrategyPatch(rollout), rollout.Patches...)); err != nil {
+			return err
+		}
+		rollout.transition(RolloutProgressing, fmt.Sprintf("step %d/%d started", rollout.CurrentStep, rollout.TotalSteps))
+		return saveRollout(rollout)
+	}
+	rollout.ModifyTime = time.Now().Unix()
+	switch o := object.(type) {
+	case *v1.StatefulSet:
+		return r.reconcileStatefulSetRollout(rollout, o)
+	case *v1.DaemonSet:
+		return r.reconcileDaemonSetRollout(rollout, o)
+	}
+	return errors.New("controller kind doesn't support stepped rollout")
+}
+
+func (r *ControllerResource) reconcileStatefulSetRollout(rollout *RolloutDB, statefulSet *v1.StatefulSet) error {
+	if err := rollout.setReplicas(*statefulSet.Spec.Replicas); err != nil {
+		return err
+	}
+	status := statefulSet.Status
+	rollout.UpdatedReplicas = status.UpdatedReplicas
+	if statefulSet.Generation > status.ObservedGeneration {
+		return saveRollout(rollout)
+	}
+	pods, err := r.updatedWorkloadPods(statefulSet)
+	if err != nil {
+		return err
+	}
+	if reason := podsHealth(pods); reason != "" {
+		return r.autoRollback(rollout, reason)
+	}
+	target := rollout.target()
+	// 继续下一步或者副本数变化后调整partition
+	partition := rollout.Replicas - target
+	if s := statefulSet.Spec.UpdateStrategy; s.RollingUpdate == nil || s.RollingUpdate.Partition == nil || *s.RollingUpdate.Partition != partition {
+		if err := patchWorkload(r, r.workloadStrategyPatch(rollout)); err != nil {
+			return err
+		}
+		return saveRollout(rollout)
+	}
+	// 更新的Pod全部就绪后当前步骤才算完成
+	if status.UpdatedReplicas < target || status.ReadyReplicas < rollout.Replicas {
+		return saveRollout(rollout)
+	}
+	rollout.PodIP = podIPs(pods)
+	return r.completeWorkloadStep(rollout)
+}
+
+func (r *ControllerResource) reconcileDaemonSetRollout(rollout *RolloutDB, daemonSet *v1.DaemonSet) error {
+	status := daemonSet.Status
+	if err := rollout.setReplicas(status.DesiredNumberScheduled); err != nil {
+		return err
+	}
+	// 模板修改后DaemonSet控制器才会创建新的版本
+	if daemonSet.Generation > status.ObservedGeneration {
+		return saveRollout(rollout)
+	}
+	hash, err := r.daemonSetUpdateHash(daemonSet)
+	if err != nil {
+		return err
+	}
+	pods, err := util.GetPodBySelectorLabel(util.GenerateLabelSelector(daemonSet.Spec.Selector.MatchLabels), r.Params.Namespace, r.Params.ClientSet)
+	if err != nil {
+		return err
+	}
+	updated := make([]corev1.Pod, 0)
+	old := make([]corev1.Pod, 0)
+	var terminating int
+	for _, pod := range pods.Items {
+		if !isOwnedBy(pod.OwnerReferences, string(daemonSet.UID)) {
+			continue
+		}
+		if pod.DeletionTimestamp != nil {
+			terminating++
+		} else if pod.Labels[v1.DefaultDaemonSetUniqueLabelKey] == hash {
+			updated = append(updated, pod)
+		} else {
+			old = append(old, pod)
+		}
+	}
+	rollout.UpdatedReplicas = int32(len(updated))
+	if reason := podsHealth(updated); reason != "" {
+		return r.autoRollback(rollout, reason)
+	}
+	// 上一批删除的Pod还未重建完成
+	if terminating > 0 || status.NumberUnavailable > 0 {
+		return saveRollout(rollout)
+	}
+	target := rollout.target()
+	if rollout.UpdatedReplicas < target && len(old) > 0 {
+		// 按节点分组顺序删除旧Pod，DaemonSet控制器使用新模板重建，每次最多删除一个步长
+		if err := r.sortPodsByNodeGroup(old, rollout.NodeGroup); err != nil {
+			return err
+		}
+		count := target - rollout.UpdatedReplicas
+		if count > rollout.StepSize {
+			count = rollout.StepSize
+		}
+		for i := 0; i < int(count) && i < len(old); i++ {
+			if err := r.Params.ClientSet.CoreV1().Pods(r.Params.Namespace).Delete(old[i].Name, &metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+				return err
+			}
+			log.Infof("Rollout %s delete pod %s on node %s", rollout.Id, old[i].Name, old[i].Spec.NodeName)
+		}
+		return saveRollout(rollout)
+	}
+	rollout.PodIP = podIPs(updated)
+	return r.completeWorkloadStep(rollout)
+}
+
+// 当前步骤完成，最后一步完成后恢复原来的更新策略
+func (r *ControllerResource) completeWorkloadStep(rollout *RolloutDB) error {
+	if rollout.target() < rollout.Replicas {
+		rollout.transition(RolloutPaused, fmt.Sprintf("step %d/%d completed, %d/%d replicas updated", rollout.CurrentStep, rollout.TotalSteps, rollout.UpdatedReplicas, rollout.Replicas))
+		return saveRollout(rollout)
+	}
+	if err := restoreWorkloadStrategy(r, rollout); err != nil {
+		return err
+	}
+	rollout.CurrentStep = rollout.TotalSteps
+	rollout.transition(RolloutCompleted, fmt.Sprintf("%d/%d replicas updated", rollout.UpdatedReplicas, rollout.Replicas))
+	return saveRollout(rollout)
+}
+
+// DaemonSet的状态中没有版本名称，最大版本号的ControllerRevision为当前模板
+func (r *ControllerResource) daemonSetUpdateHash(daemonSet *v1.DaemonSet) (string, error) {
+	list, err := r.Params.ClientSet.AppsV1().ControllerRevisions(r.Params.Namespace).List(metav1.ListOptions{LabelSelector: util.GenerateLabelSelector(daemonSet.Spec.Selector.MatchLabels)})
+	if err != nil {
+		return "", err
+	}
+	var latest *v1.ControllerRevision
+	for i, history := range list.Items {
+		if !metav1.IsControlledBy(&history, daemonSet) {
+			continue
+		}
+		if latest == nil || history.Revision > latest.Revision {
+			latest = &list.Items[i]
+		}
+	}
+	if latest == nil {
+		return "", errors.New("daemonset revision not found")
+	}
+	return latest.Labels[v1.DefaultDaemonSetUniqueLabelKey], nil
+}
+
+// 使用当前模板的Pod，通过controller-revision-hash标签区分
+func (r *ControllerResource) updatedWorkloadPods(object interface{}) ([]corev1.Pod, error) {
+	var uid types.UID
+	var selector *metav1.LabelSelector
+	var hash string
+	switch o := object.(type) {
+	case *v1.StatefulSet:
+		uid, selector, hash = o.UID, o.Spec.Selector, o.Status.UpdateRevision
+	case *v1.DaemonSet:
+		updateHash, err := r.daemonSetUpdateHash(o)
+		if err != nil {
+			return nil, err
+		}
+		uid, selector, hash = o.UID, o.Spec.Selector, updateHash
+	default:
+		return nil, errors.New("controller kind doesn't support stepped rollout")
+	}
+	pods, err := util.GetPodBySelectorLabel(util.GenerateLabelSelector(selector.MatchLabels), r.Params.Namespace, r.Params.ClientSet)
+	if err != nil {
+		return nil, err
+	}
+	updated := make([]corev1.Pod, 0)
+	for _, pod := range pods.Items {
+		if isOwnedBy(pod.OwnerReferences, string(uid)) && pod.DeletionTimestamp == nil && pod.Labels[v1.ControllerRevisionHashLabelKey] == hash {
+			updated = append(updated, pod)
+		}
+	}
+	return updated, nil
+}
+
+// 按节点标签的值分组排序，同一组内按节点名称排序，没有指定标签时只按节点名称排序
+func (r *ControllerResource) sortPodsByNodeGroup(pods []corev1.Pod, nodeGroup string) error {
+	groups := make(map[string]string)
+	if nodeGroup != "" {
+		nodes, err := r.Params.ClientSet.CoreV1().Nodes().List(metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes.Items {
+			groups[node.Name] = node.Labels[nodeGroup]
+		}
+	}
+	sort.SliceStable(pods, func(i, j int) bool {
+		gi, gj := groups[pods[i].Spec.NodeName], groups[pods[j].Spec.NodeName]
+		if gi != gj {
+			return gi < gj
+		}
+		return pods[i].Spec.NodeName < pods[j].Spec.NodeName
+	})
+	return nil
+}
+
+// 和WatchPodIP返回相同的结构
+func (r *ControllerResource) workloadPodIP() (map[string]interface{}, error) {
+	object, err := r.Get()
+	if err != nil {
+		return nil, err
+	}
+	var replicas, updatedReplicas, unavailableReplicas int32
+	switch o := object.(type) {
+	case *v1.StatefulSet:
+		replicas, updatedReplicas = *o.Spec.Replicas, o.Status.UpdatedReplicas
+		unavailableReplicas = replicas - o.Status.ReadyReplicas
+	case *v1.DaemonSet:
+		replicas, updatedReplicas, unavailableReplicas = o.Status.DesiredNumberScheduled, o.Status.UpdatedNumberScheduled, o.Status.NumberUnavailable
+	default:
+		return nil, errors.New("controller kind doesn't support stepped rollout")
+	}
+	podIP := make([]string, 0)
+	if pods, err := r.updatedWorkloadPods(object); err != nil {
+		log.Errorf("updatedWorkloadPods error: %s", err)
+	} else {
+		podIP = podIPs(pods)
+	}
+	res := map[string]interface{}{"replicas": replicas, "updatedReplicas": updatedReplicas, "unavailableReplicas": unavailableReplicas, "podIP": podIP}
+	if unavailableReplicas <= 0 {
+		res["groupCompleted"] = 1
+	}
+	return res, nil
+}
+
+// 恢复滚动更新，Deployment取消暂停，StatefulSet立即调整partition，DaemonSet由RolloutReconciler删除旧Pod
+func (r *ControllerResource) resumeRollout(rollout *RolloutDB) error {
+	switch rollout.Kind {
+	case "deployment":
+		return r.SetResume()
+	case "statefulset":
+		r.Params.PatchData.Patches = r.workloadStrategyPatch(rollout)
+		_, err := r.Patch()
+		return err
+	}
+	return nil
+}
+
+// 手动暂停，StatefulSet把partition设置为已更新的边界，DaemonSet为OnDelete不会继续更新
+func (r *ControllerResource) pauseRollout() error {
+	switch r.Params.Controller {
+	case "deployment":
+		return r.SetPause()
+	case "statefulset":
+		object, err := r.Get()
+		if err != nil {
+			return err
+		}
+		statefulSet, ok := object.(*v1.StatefulSet)
+		if !ok {
+			return errors.New("statefulset assert error")
+		}
+		partition := *statefulSet.Spec.Replicas - statefulSet.Status.UpdatedReplicas
+		if partition < 0 {
+			partition = 0
+		}
+		r.Params.PatchData.Patches = statefulSetPartitionPatch(partition)
+		_, err = r.Patch()
+		return err
+	case "daemonset":
+		return nil
+	}
+	return errors.New("controller kind doesn't support stepped rollout")
+}
+
+// 健康检查失败时停止继续更新，StatefulSet的partition设置为副本数
+func haltRollout(r *ControllerResource, rollout *RolloutDB) error {
+	switch rollout.Kind {
+	case "deployment":
+		return setDeploymentPaused(r, true)
+	case "statefulset":
+		return patchWorkload(r, statefulSetPartitionPatch(rollout.Replicas))
+	}
+	return nil
+}
+
+// 回滚到上线前的版本，StatefulSet和DaemonSet先回滚模板再恢复更新策略，已更新的Pod会被替换回旧版本
+func (r *ControllerResource) rollbackRollout(rollout *RolloutDB) error {
+	if rollout.Kind == "deployment" {
+		if err := setDeploymentPaused(r, false); err != nil {
+			return err
+		}
+		if rollout.FromRevision == 0 {
+			return nil
+		}
+		_, err := r.Rollback(rollout.FromRevision)
+		return err
+	}
+	if rollout.FromRevision > 0 {
+		if _, err := r.Rollback(rollout.FromRevision); err != nil {
+			return err
+		}
+	}
+	return restoreWorkloadStrategy(r, rollout)
+}
+
+func podIPs(pods []corev1.Pod) []string {
+	podIP := make([]string, 0, len(pods))
+	for _, pod := range pods {
+		if pod.Status.PodIP != "" {
+			podIP = append(podIP, pod.Status.PodIP)
+		}
+	}
+	return podIP
+}
+
+// 审计日志和事件使用的控制器类型
+func rolloutKind(kind string) (string, string) {
+	switch kind {
+	case "statefulset":
+		return common.StatefulSet, "StatefulSet"
+	case "daemonset":
+		return common.DaemonSet, "DaemonSet"
+	}
+	return common.Deployment, "Deployment"
+}
@@ -0,0 +1,364 @@
+package resource
+
+import (
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-k8s/util"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/access"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"github.com/open-kingfisher/king-utils/db"
+	"github.com/open-kingfisher/king-utils/kit"
+	"github.com/open-kingfisher/king-utils/middleware/jwt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ScaleScheduleTable = "scale_schedule"
+	ScaleSchedule      = "scale_schedule"
+)
+
+// 在cron表达式对应的时间把副本数修改为Replicas
+type ScaleScheduleRule struct {
+	Cron     string `json:"cron"`
+	Replicas int32  `json:"replicas"`
+}
+
+// 定时扩缩容策略，保存在数据库中，由ScaleScheduler按分钟执行
+type ScaleScheduleDB struct {
+	Id        string              `json:"id"`
+	Cluster   string              `json:"cluster"`
+	Namespace string              `json:"namespace"`
+	Kind      string              `json:"kind"`
+	Name      string              `json:"name"`
+	Rules     []ScaleScheduleRule `json:"rules"`
+	// cron表达式使用的时区，为空时使用服务所在时区
+	TimeZone    string `json:"timeZone"`
+	Enabled     bool   `json:"enabled"`
+	User        string `json:"user"`
+	LastRun     int64  `json:"lastRun"`
+	LastMessage string `json:"lastMessage"`
+	// 下一次执行时间，查询时计算
+	NextRun    int64 `json:"nextRun,omitempty"`
+	CreateTime int64 `json:"createTime"`
+	ModifyTime int64 `json:"modifyTime"`
+}
+
+type ScaleScheduleResource struct {
+	Params   *handle.Resources
+	PostData *ScaleScheduleDB
+}
+
+// 命名空间下的定时扩缩容策略，指定kind和kindName时只返回此控制器的策略
+func (r *ScaleScheduleResource) List() ([]*ScaleScheduleDB, error) {
+	schedules := make([]*ScaleScheduleDB, 0)
+	clause := "WHERE data->'$.cluster'=? AND data->'$.namespace'=?"
+	args := []interface{}{r.Params.Cluster, r.Params.Namespace}
+	if r.Params.Kind != "" && r.Params.KindName != "" {
+		clause += " AND data->'$.kind'=? AND data->'$.name'=?"
+		args = append(args, r.Params.Kind, r.Params.KindName)
+	}
+	if err := db.List(common.DataField, ScaleScheduleTable, &schedules, clause+" ORDER BY data->'$.createTime' DESC", args...); err != nil {
+		return nil, err
+	}
+	for _, schedule := range schedules {
+		schedule.NextRun = schedule.next(time.Now())
+	}
+	return schedules, nil
+}
+
+func (r *ScaleScheduleResource) Get() (*ScaleScheduleDB, error) {
+	schedule := &ScaleScheduleDB{}
+	if err := db.GetById(ScaleScheduleTable, r.Params.Name, schedule); err != nil {
+		return nil, err
+	}
+	if schedule.Cluster != r.Params.Cluster || schedule.Namespace != r.Params.Namespace {
+		return nil, errors.New("scale schedule not found")
+	}
+	schedule.NextRun = schedule.next(time.Now())
+	return schedule, nil
+}
+
+func (r *ScaleScheduleResource) Create() (*ScaleScheduleDB, error) {
+	if err := r.verify(); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	r.PostData.Id = kit.UUID("s")
+	r.PostData.Cluster = r.Params.Cluster
+	r.PostData.Namespace = r.Params.Namespace
+	r.PostData.User = r.Params.User.Name
+	r.PostData.LastRun = 0
+	r.PostData.LastMessage = ""
+	r.PostData.NextRun = 0
+	r.PostData.CreateTime = now
+	r.PostData.ModifyTime = now
+	if err := db.Insert(ScaleScheduleTable, r.PostData); err != nil {
+		log.Errorf("Scale schedule add error:%s; Json:%+v;", err, r.PostData)
+		return nil, err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       ScaleSchedule,
+		ActionType: common.Create,
+		Resources:  r.Params,
+		Name:       r.PostData.Name,
+		PostData:   r.PostData,
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return nil, err
+	}
+	return r.PostData, nil
+}
+
+// 只能修改规则、时区以及是否启用，控制器不能修改
+func (r *ScaleScheduleResource) Update() (*ScaleScheduleDB, error) {
+	schedule, err := r.Get()
+	if err != nil {
+		return nil, err
+	}
+	r.PostData.Kind = schedule.Kind
+	r.PostData.Name = schedule.Name
+	if err := r.verify(); err != nil {
+		return nil, err
+	}
+	schedule.Rules = r.PostData.Rules
+	schedule.TimeZone = r.PostData.TimeZone
+	schedule.Enabled = r.PostData.Enabled
+	schedule.User = r.Params.User.Name
+	schedule.NextRun = 0
+	schedule.ModifyTime = time.Now().Unix()
+	if err := db.Update(ScaleScheduleTable, schedule.Id, schedule); err != nil {
+		log.Errorf("Scale schedule update error:%s; Json:%+v;", err, schedule)
+		return nil, err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       ScaleSchedule,
+		ActionType: common.Update,
+		Resources:  r.Params,
+		Name:       schedule.Name,
+		PostData:   schedule,
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+func (r *ScaleScheduleResource) Delete() error {
+	schedule, err := r.Get()
+	if err != nil {
+		return err
+	}
+	if err := db.Delete(ScaleScheduleTable, schedule.Id); err != nil {
+		return err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       ScaleSchedule,
+		ActionType: common.Delete,
+		Resources:  r.Params,
+		Name:       schedule.Name,
+		PostData:   schedule,
+	}
+	return auditLog.InsertAuditLog()
+}
+
+// 校验控制器、cron表达式、副本数以及时区
+func (r *ScaleScheduleResource) verify() error {
+	if r.PostData.Kind != "deployment" && r.PostData.Kind != "statefulset" {
+		return errors.New("only deployment and statefulset support scale schedule")
+	}
+	if len(r.PostData.Rules) == 0 {
+		return errors.New("rules cannot be empty")
+	}
+	for _, rule := range r.PostData.Rules {
+		if _, err := util.ParseCron(rule.Cron); err != nil {
+			return err
+		}
+		if rule.Replicas < 0 {
+			return errors.New("replicas less then 0")
+		}
+	}
+	if _, err := time.LoadLocation(r.PostData.TimeZone); err != nil {
+		return err
+	}
+	params := *r.Params
+	params.Controller = r.PostData.Kind
+	params.Name = r.PostData.Name
+	controller := ControllerResource{Params: &params}
+	if _, err := controller.Get(); err != nil {
+		return err
+	}
+	// 有HPA时修改的是HPA的最小副本数，不能超过HPA的最大副本数
+	hpaParams := params
+	hpaParams.Kind = params.Controller
+	hpaParams.KindName = params.Name
+	hpa := HPAResource{Params: &hpaParams}
+	list, err := hpa.List()
+	if err != nil {
+		return err
+	}
+	for _, item := range list.Items {
+		for _, rule := range r.PostData.Rules {
+			if rule.Replicas > item.Spec.MaxReplicas {
+				return fmt.Errorf("replicas %d of rule %s exceeds maxReplicas %d of HPA %s", rule.Replicas, rule.Cron, item.Spec.MaxReplicas, item.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// time.LoadLocation("")返回UTC，为空时需要使用服务所在时区
+func (schedule *ScaleScheduleDB) location() *time.Location {
+	if schedule.TimeZone == "" {
+		return time.Local
+	}
+	location, err := time.LoadLocation(schedule.TimeZone)
+	if err != nil {
+		return time.Local
+	}
+	return location
+}
+
+func (schedule *ScaleScheduleDB) next(t time.Time) int64 {
+	if !schedule.Enabled {
+		return 0
+	}
+	var next time.Time
+	for _, rule := range schedule.Rules {
+		cron, err := util.ParseCron(rule.Cron)
+		if err != nil {
+			continue
+		}
+		if n, err := cron.Next(t.In(schedule.location())); err == nil && (next.IsZero() || n.Before(next)) {
+			next = n
+		}
+	}
+	if next.IsZero() {
+		return 0
+	}
+	return next.Unix()
+}
+
+// 每分钟检查一次所有启用的定时扩缩容策略，只执行当前分钟匹配的规则
+// 服务停止或者检查延迟期间错过的执行不会补偿，多个副本同时运行时每分钟只有一个副本执行
+func ScaleScheduler() {
+	for {
+		// 对齐到下一分钟的开始
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		now = time.Now().Truncate(time.Minute)
+		schedules := make([]*ScaleScheduleDB, 0)
+		if err := db.List(common.DataField, ScaleScheduleTable, &schedules, ""); err != nil {
+			log.Errorf("Scale scheduler list error: %s", err)
+			continue
+		}
+		for _, schedule := range schedules {
+			// 同一分钟只执行一次
+			if !schedule.Enabled || schedule.LastRun >= now.Unix() {
+				continue
+			}
+			for _, rule := range schedule.Rules {
+				cron, err := util.ParseCron(rule.Cron)
+				if err != nil || !cron.Match(now.In(schedule.location())) {
+					continue
+				}
+				if claimed, err := claimScaleSchedule(schedule, now); err != nil {
+					log.Errorf("Scale schedule claim error:%s; Id:%s", err, schedule.Id)
+				} else if claimed {
+					runScaleSchedule(schedule, rule)
+				}
+				break
+			}
+		}
+	}
+}
+
+// 根据读取时的lastRun有条件地更新，更新成功的副本获得本次执行权
+func claimScaleSchedule(schedule *ScaleScheduleDB, now time.Time) (bool, error) {
+	result, err := db.DB.Exec("UPDATE "+ScaleScheduleTable+" SET data=JSON_SET(data, '$.lastRun', ?) WHERE data->'$.id'=? AND data->'$.lastRun'=?",
+		now.Unix(), schedule.Id, schedule.LastRun)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	schedule.LastRun = now.Unix()
+	return rows == 1, nil
+}
+
+func runScaleSchedule(schedule *ScaleScheduleDB, rule ScaleScheduleRule) {
+	message, err := scaleBySchedule(schedule, rule)
+	if err != nil {
+		message = err.Error()
+		log.Errorf("Scale schedule %s %s/%s error: %s", schedule.Id, schedule.Namespace, schedule.Name, err)
+	} else {
+		log.Infof("Scale schedule %s %s/%s: %s", schedule.Id, schedule.Namespace, schedule.Name, message)
+	}
+	schedule.LastMessage = fmt.Sprintf("%s: %s", rule.Cron, message)
+	// 只更新执行结果，不覆盖执行期间对策略的修改
+	_, err = db.DB.Exec("UPDATE "+ScaleScheduleTable+" SET data=JSON_SET(data, '$.lastMessage', ?) WHERE data->'$.id'=?", schedule.LastMessage, schedule.Id)
+	if err != nil {
+		log.Errorf("Scale schedule update error:%s; Id:%s", err, schedule.Id)
+	}
+}
+
+// 有HPA时修改HPA的最小副本数，否则直接修改控制器副本数
+func scaleBySchedule(schedule *ScaleScheduleDB, rule ScaleScheduleRule) (string, error) {
+	clientSet, err := access.Access(schedule.Cluster)
+	if err != nil {
+		return "", err
+	}
+	params := &handle.Resources{
+		Cluster:    schedule.Cluster,
+		Namespace:  schedule.Namespace,
+		Name:       schedule.Name,
+		Controller: schedule.Kind,
+		Scale:      strconv.Itoa(int(rule.Replicas)),
+		ClientSet:  clientSet,
+		// 后台操作记录在创建策略的用户名下
+		User: &jwt.CustomClaims{Name: schedule.User},
+	}
+	controller := ControllerResource{Params: params}
+	hpa, err := controller.scaleTargetHPA()
+	if err != nil {
+		return "", err
+	}
+	if len(hpa) == 0 {
+		result, err := controller.Scale()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("scaled from %d to %d", result.PreviousReplicas, result.Replicas), nil
+	}
+	// HPA的最小副本数不能为0
+	if rule.Replicas < 1 {
+		return "", fmt.Errorf("%s is managed by HPA %s, minReplicas cannot be less than 1", schedule.Name, strings.Join(hpa, ","))
+	}
+	hpaParams := *params
+	hpaResource := HPAResource{Params: &hpaParams}
+	// 先检查所有HPA，避免只修改了其中一部分
+	for _, name := range hpa {
+		hpaParams.Name = name
+		current, err := hpaResource.Get()
+		if err != nil {
+			return "", err
+		}
+		// 最小副本数不能大于最大副本数，创建策略后HPA的最大副本数可能被修改
+		if rule.Replicas > current.Spec.MaxReplicas {
+			return "", fmt.Errorf("replicas %d exceeds maxReplicas %d of HPA %s", rule.Replicas, current.Spec.MaxReplicas, name)
+		}
+	}
+	hpaParams.PatchData = &common.PatchJson{Patches: []common.PatchData{{Op: "replace", Path: "/spec/minReplicas", Value: rule.Replicas}}}
+	for _, name := range hpa {
+		hpaParams.Name = name
+		if _, err := hpaResource.Patch(); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("HPA %s minReplicas set to %d", strings.Join(hpa, ","), rule.Replicas), nil
+}
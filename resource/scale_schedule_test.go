@@ -0,0 +1,25 @@
+package resource
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScaleScheduleLocation(t *testing.T) {
+	tests := []struct {
+		timeZone string
+		want     string
+	}{
+		// 为空时使用服务所在时区，而不是time.LoadLocation("")返回的UTC
+		{"", time.Local.String()},
+		{"UTC", "UTC"},
+		{"Asia/Shanghai", "Asia/Shanghai"},
+		{"Invalid/Zone", time.Local.String()},
+	}
+	for _, test := range tests {
+		schedule := &ScaleScheduleDB{TimeZone: test.timeZone}
+		if got := schedule.location().String(); got != test.want {
+			t.Errorf("location(%q) = %s, want %s", test.timeZone, got, test.want)
+		}
+	}
+}
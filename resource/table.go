@@ -0,0 +1,18 @@
+package resource
+
+import (
+	"github.com/open-kingfisher/king-utils/db"
+)
+
+// 本服务新增的数据表，结构与其他数据表相同
+var tables = []string{RolloutTable, ScaleScheduleTable, TemplateVersionTable}
+
+// 数据表不存在时创建，需要在服务开始处理请求以及后台任务启动前调用
+func CreateTables() error {
+	for _, table := range tables {
+		if _, err := db.DB.Exec("CREATE TABLE IF NOT EXISTS " + table + " (id INT NOT NULL AUTO_INCREMENT, data JSON NOT NULL, PRIMARY KEY (id))"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
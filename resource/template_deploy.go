@@ -0,0 +1,233 @@
+package resource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/db"
+	"k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	TemplatePreviewAction = common.ActionType("template_preview")
+	// 从模板创建的控制器带有模板的Id
+	TemplateAnnotation = "kingfisher.io/template"
+)
+
+// 从模板创建控制器时的参数，镜像、环境变量以及资源按容器名称指定
+type TemplateDeployData struct {
+	Name      string                                 `json:"name"`
+	Images    map[string]string                      `json:"images"`
+	Replicas  *int32                                 `json:"replicas"`
+	Env       map[string]map[string]string           `json:"env"`
+	Resources map[string]corev1.ResourceRequirements `json:"resources"`
+}
+
+type TemplatePreview struct {
+	Kind     string      `json:"kind"`
+	Object   interface{} `json:"object"`
+	Manifest string      `json:"manifest"`
+}
+
+type TemplateDeployResource struct {
+	Params   *handle.Resources
+	PostData *TemplateDeployData
+	// 使用的模板版本，为0时使用默认版本
+	Version int
+}
+
+// 渲染模板，返回最终创建的对象以及YAML，不会创建
+func (r *TemplateDeployResource) Preview() (*TemplatePreview, error) {
+	template, object, err := r.render()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := yaml.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	return &TemplatePreview{Kind: template.Kind, Object: object, Manifest: string(manifest)}, nil
+}
+
+// 渲染模板并在请求的集群和命名空间中创建控制器
+func (r *TemplateDeployResource) Deploy() (interface{}, error) {
+	template, object, err := r.render()
+	if err != nil {
+		return nil, err
+	}
+	params := *r.Params
+	params.Controller = template.Kind
+	controller := ControllerResource{Params: &params}
+	switch o := object.(type) {
+	case *v1.Deployment:
+		controller.DeploymentData = o
+	case *v1.DaemonSet:
+		controller.DaemonSetData = o
+	case *v1.StatefulSet:
+		controller.StatefulSetData = o
+	}
+	return controller.Create()
+}
+
+func (r *TemplateDeployResource) render() (*common.TemplateDB, interface{}, error) {
+	if r.PostData == nil || r.PostData.Name == "" {
+		return nil, nil, errors.New("name cannot be empty")
+	}
+	if errs := validation.IsDNS1123Subdomain(r.PostData.Name); len(errs) > 0 {
+		return nil, nil, fmt.Errorf("invalid name %s: %s", r.PostData.Name, strings.Join(errs, ","))
+	}
+	if r.PostData.Replicas != nil && *r.PostData.Replicas < 0 {
+		return nil, nil, errors.New("replicas less then 0")
+	}
+	template := &common.TemplateDB{}
+	if err := db.GetById(common.TemplateTable, r.Params.Name, template); err != nil {
+		return nil, nil, err
+	}
+	// 没有指定版本时使用默认版本
+	versions, err := listTemplateVersion(template)
+	if err != nil {
+		return nil, nil, err
+	}
+	version, err := findTemplateVersion(versions, r.Version)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(version.Spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	var object interface{}
+	var meta *metav1.ObjectMeta
+	var selector *metav1.LabelSelector
+	var podTemplate *corev1.PodTemplateSpec
+	switch template.Kind {
+	case "deployment":
+		deployment := &v1.Deployment{}
+		if err := json.Unmarshal(data, deployment); err != nil {
+			return nil, nil, err
+		}
+		deployment.Kind, deployment.APIVersion = "Deployment", "apps/v1"
+		if r.PostData.Replicas != nil {
+			deployment.Spec.Replicas = r.PostData.Replicas
+		}
+		object, meta, selector, podTemplate = deployment, &deployment.ObjectMeta, deployment.Spec.Selector, &deployment.Spec.Template
+	case "statefulset":
+		statefulSet := &v1.StatefulSet{}
+		if err := json.Unmarshal(data, statefulSet); err != nil {
+			return nil, nil, err
+		}
+		statefulSet.Kind, statefulSet.APIVersion = "StatefulSet", "apps/v1"
+		if r.PostData.Replicas != nil {
+			statefulSet.Spec.Replicas = r.PostData.Replicas
+		}
+		object, meta, selector, podTemplate = statefulSet, &statefulSet.ObjectMeta, statefulSet.Spec.Selector, &statefulSet.Spec.Template
+	case "daemonset":
+		if r.PostData.Replicas != nil {
+			return nil, nil, errors.New("daemonset doesn't support replicas")
+		}
+		daemonSet := &v1.DaemonSet{}
+		if err := json.Unmarshal(data, daemonSet); err != nil {
+			return nil, nil, err
+		}
+		daemonSet.Kind, daemonSet.APIVersion = "DaemonSet", "apps/v1"
+		object, meta, selector, podTemplate = daemonSet, &daemonSet.ObjectMeta, daemonSet.Spec.Selector, &daemonSet.Spec.Template
+	default:
+		return nil, nil, errors.New("controller kind doesn't exist")
+	}
+	// 标签中使用原名称的替换为新名称，避免和原控制器使用相同的选择器
+	oldName := meta.Name
+	meta.Name = r.PostData.Name
+	meta.Namespace = r.Params.Namespace
+	renameLabels(meta.Labels, oldName, r.PostData.Name)
+	renameLabels(podTemplate.Labels, oldName, r.PostData.Name)
+	if selector != nil {
+		renameLabels(selector.MatchLabels, oldName, r.PostData.Name)
+	}
+	// 去掉原控制器的版本、变更原因等注解
+	for _, key := range []string{DeploymentRevision, ChangeCause, PreviousReplicas, RolloutAnnotation, corev1.LastAppliedConfigAnnotation} {
+		delete(meta.Annotations, key)
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	meta.Annotations[TemplateAnnotation] = template.Id
+	meta.Annotations[TemplateVersionAnnotation] = strconv.Itoa(version.Version)
+	if err := r.renderContainers(podTemplate); err != nil {
+		return nil, nil, err
+	}
+	return template, object, nil
+}
+
+// 替换容器的镜像、环境变量以及资源，指定的容器必须在模板中存在
+func (r *TemplateDeployResource) renderContainers(podTemplate *corev1.PodTemplateSpec) error {
+	containers := make(map[string]*corev1.Container)
+	for i := range podTemplate.Spec.InitContainers {
+		containers[podTemplate.Spec.InitContainers[i].Name] = &podTemplate.Spec.InitContainers[i]
+	}
+	for i := range podTemplate.Spec.Containers {
+		containers[podTemplate.Spec.Containers[i].Name] = &podTemplate.Spec.Containers[i]
+	}
+	for name, image := range r.PostData.Images {
+		container, ok := containers[name]
+		if !ok {
+			return fmt.Errorf("container %s not found in template", name)
+		}
+		container.Image = image
+	}
+	for name, env := range r.PostData.Env {
+		container, ok := containers[name]
+		if !ok {
+			return fmt.Errorf("container %s not found in template", name)
+		}
+		// 按名称排序，新增的环境变量顺序固定
+		keys := make([]string, 0, len(env))
+		for key := range env {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := env[key]
+			found := false
+			for i := range container.Env {
+				if container.Env[i].Name == key {
+					container.Env[i] = corev1.EnvVar{Name: key, Value: value}
+					found = true
+				}
+			}
+			if !found {
+				container.Env = append(container.Env, corev1.EnvVar{Name: key, Value: value})
+			}
+		}
+	}
+	for name, resources := range r.PostData.Resources {
+		container, ok := containers[name]
+		if !ok {
+			return fmt.Errorf("container %s not found in template", name)
+		}
+		container.Resources = resources
+	}
+	// 模板中没有镜像的容器必须通过参数指定
+	for name, container := range containers {
+		if container.Image == "" {
+			return fmt.Errorf("image of container %s is required", name)
+		}
+	}
+	return nil
+}
+
+func renameLabels(labels map[string]string, oldName, newName string) {
+	for k, v := range labels {
+		if v == oldName {
+			labels[k] = newName
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package resource
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"reflect"
+	"testing"
+)
+
+func templatePodSpec() *corev1.PodTemplateSpec {
+	return &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "busybox"}},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "nginx:1", Env: []corev1.EnvVar{{Name: "MODE", Value: "dev"}}},
+				{Name: "sidecar", Image: "envoy"},
+			},
+		},
+	}
+}
+
+func TestRenderContainers(t *testing.T) {
+	limits := corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}}
+	r := &TemplateDeployResource{PostData: &TemplateDeployData{
+		Images:    map[string]string{"app": "nginx:2", "init": "busybox:1.31"},
+		Env:       map[string]map[string]string{"app": {"MODE": "prod", "B": "2", "A": "1"}},
+		Resources: map[string]corev1.ResourceRequirements{"sidecar": limits},
+	}}
+	podTemplate := templatePodSpec()
+	if err := r.renderContainers(podTemplate); err != nil {
+		t.Fatal(err)
+	}
+	if image := podTemplate.Spec.InitContainers[0].Image; image != "busybox:1.31" {
+		t.Errorf("init container image = %q, want busybox:1.31", image)
+	}
+	app := podTemplate.Spec.Containers[0]
+	if app.Image != "nginx:2" {
+		t.Errorf("app image = %q, want nginx:2", app.Image)
+	}
+	// 已有的环境变量原位替换，新增的按名称排序追加
+	wantEnv := []corev1.EnvVar{{Name: "MODE", Value: "prod"}, {Name: "A", Value: "1"}, {Name: "B", Value: "2"}}
+	if !reflect.DeepEqual(app.Env, wantEnv) {
+		t.Errorf("app env = %v, want %v", app.Env, wantEnv)
+	}
+	sidecar := podTemplate.Spec.Containers[1]
+	if sidecar.Image != "envoy" || !reflect.DeepEqual(sidecar.Resources, limits) {
+		t.Errorf("sidecar = %+v, want image envoy with resources %+v", sidecar, limits)
+	}
+}
+
+func TestRenderContainersError(t *testing.T) {
+	tests := []struct {
+		name     string
+		postData *TemplateDeployData
+		image    string
+	}{
+		{"unknown image container", &TemplateDeployData{Images: map[string]string{"web": "nginx"}}, "nginx:1"},
+		{"unknown env container", &TemplateDeployData{Env: map[string]map[string]string{"web": {"A": "1"}}}, "nginx:1"},
+		{"unknown resources container", &TemplateDeployData{Resources: map[string]corev1.ResourceRequirements{"web": {}}}, "nginx:1"},
+		// 模板中没有镜像时必须通过参数指定
+		{"missing image", &TemplateDeployData{}, ""},
+	}
+	for _, test := range tests {
+		podTemplate := templatePodSpec()
+		podTemplate.Spec.Containers[0].Image = test.image
+		r := &TemplateDeployResource{PostData: test.postData}
+		if err := r.renderContainers(podTemplate); err == nil {
+			t.Errorf("%s: renderContainers() error = nil, want error", test.name)
+		}
+	}
+}
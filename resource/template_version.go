@@ -0,0 +1,455 @@
+package resource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"github.com/open-kingfisher/king-utils/db"
+	"github.com/open-kingfisher/king-utils/kit"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TemplateVersionTable   = "template_version"
+	TemplateVersionList    = common.ActionType("template_version_list")
+	TemplateVersionDiff    = common.ActionType("template_version_diff")
+	TemplateVersionDefault = common.ActionType("template_version_default")
+	// 从模板创建的控制器带有使用的模板版本
+	TemplateVersionAnnotation = "kingfisher.io/template-version"
+)
+
+// 模板的每次保存都是一个不可修改的版本，模板表中的spec为默认版本的spec
+type TemplateVersionDB struct {
+	Id         string      `json:"id"`
+	TemplateId string      `json:"templateId"`
+	Version    int         `json:"version"`
+	Name       string      `json:"name"`
+	Kind       string      `json:"kind"`
+	Describe   string      `json:"describe"`
+	Author     string      `json:"author"`
+	Default    bool        `json:"default"`
+	Spec       interface{} `json:"spec,omitempty"`
+	CreateTime int64       `json:"createTime"`
+}
+
+// 两个版本之间的一处差异，path为JSON路径，op为add、remove或者replace
+type TemplateChange struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+type TemplateVersionDiffResult struct {
+	From    *TemplateVersionDB `json:"from"`
+	To      *TemplateVersionDB `json:"to"`
+	Changes []TemplateChange   `json:"changes"`
+}
+
+type TemplateVersionResource struct {
+	Params *handle.Resources
+}
+
+// 创建版本以及修改默认版本在同一进程内串行执行，多个副本之间插入版本时检查版本号是否已经存在
+var templateVersionLock sync.Mutex
+
+var errTemplateVersionConflict = errors.New("template version already exists")
+
+// 保存模板，同名模板已经存在时创建新的版本，第一个版本或者setDefault为true时设置为默认版本
+func saveTemplateVersion(template *common.TemplateDB, author string, setDefault bool) (*TemplateVersionDB, error) {
+	templateVersionLock.Lock()
+	defer templateVersionLock.Unlock()
+	current, err := findTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		if err := handle.CreateTemplate(template); err != nil {
+			return nil, err
+		}
+		return insertTemplateVersion(template, author, 1, true)
+	}
+	var versions []*TemplateVersionDB
+	var version *TemplateVersionDB
+	// 其他副本同时保存了新版本时重新读取版本号
+	for i := 0; i < 3; i++ {
+		if versions, err = backfillTemplateVersion(current); err != nil {
+			return nil, err
+		}
+		version, err = insertTemplateVersion(&common.TemplateDB{
+			Id:       current.Id,
+			Name:     current.Name,
+			Kind:     current.Kind,
+			Describe: template.Describe,
+			Spec:     template.Spec,
+		}, author, versions[0].Version+1, setDefault)
+		if err != errTemplateVersionConflict {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if setDefault {
+		if err := setDefaultTemplateVersion(current, versions, version); err != nil {
+			return nil, err
+		}
+	}
+	*template = *current
+	return version, nil
+}
+
+// 指定了Id时按Id查找，否则按名称和类型查找，不存在时返回nil
+// 版本功能之前可以保存多个同名模板，此时无法确定新版本属于哪个模板，需要指定Id
+func findTemplate(template *common.TemplateDB) (*common.TemplateDB, error) {
+	if template.Id != "" {
+		current := &common.TemplateDB{}
+		if err := db.GetById(common.TemplateTable, template.Id, current); err != nil {
+			return nil, fmt.Errorf("template %s not found", template.Id)
+		}
+		if current.Kind != template.Kind {
+			return nil, fmt.Errorf("template %s is a %s template", template.Id, current.Kind)
+		}
+		return current, nil
+	}
+	templateList := make([]*common.TemplateDB, 0)
+	if err := db.List(common.DataField, common.TemplateTable, &templateList, "WHERE data-> '$.name'=? and data-> '$.kind'=?", template.Name, template.Kind); err != nil {
+		return nil, err
+	}
+	switch len(templateList) {
+	case 0:
+		return nil, nil
+	case 1:
+		return templateList[0], nil
+	}
+	return nil, fmt.Errorf("%d %s templates are named %s, specify the template id", len(templateList), template.Kind, template.Name)
+}
+
+func insertTemplateVersion(template *common.TemplateDB, author string, number int, isDefault bool) (*TemplateVersionDB, error) {
+	version := &TemplateVersionDB{
+		Id:         kit.UUID("v"),
+		TemplateId: template.Id,
+		Version:    number,
+		Name:       template.Name,
+		Kind:       template.Kind,
+		Describe:   template.Describe,
+		Author:     author,
+		Default:    isDefault,
+		Spec:       template.Spec,
+		CreateTime: time.Now().Unix(),
+	}
+	data, err := json.Marshal(version)
+	if err != nil {
+		return nil, err
+	}
+	// 同一个模板的版本号已经存在时不插入
+	result, err := db.DB.Exec("INSERT INTO "+TemplateVersionTable+" (data) SELECT CAST(? AS JSON) FROM DUAL WHERE NOT EXISTS ("+
+		"SELECT 1 FROM "+TemplateVersionTable+" WHERE data->'$.templateId'=? AND data->'$.version'=?)", string(data), template.Id, number)
+	if err == nil {
+		var rows int64
+		if rows, err = result.RowsAffected(); err == nil && rows == 0 {
+			err = errTemplateVersionConflict
+		}
+	}
+	if err != nil {
+		log.Errorf("Template version add error:%s; Template:%s; Version:%d", err, template.Id, number)
+		return nil, err
+	}
+	return version, nil
+}
+
+// 按版本号倒序，版本功能之前保存的模板把当前内容作为第一个版本返回，不写入数据库
+func listTemplateVersion(template *common.TemplateDB) ([]*TemplateVersionDB, error) {
+	versions := make([]*TemplateVersionDB, 0)
+	if err := db.List(common.DataField, TemplateVersionTable, &versions, "WHERE data->'$.templateId'=?", template.Id); err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		versions = append(versions, &TemplateVersionDB{
+			TemplateId: template.Id,
+			Version:    1,
+			Name:       template.Name,
+			Kind:       template.Kind,
+			Describe:   template.Describe,
+			Default:    true,
+			Spec:       template.Spec,
+			CreateTime: template.CreateTime,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version > versions[j].Version
+	})
+	return versions, nil
+}
+
+// 修改版本前调用，版本功能之前保存的模板把当前内容保存为第一个版本，需要持有templateVersionLock
+func backfillTemplateVersion(template *common.TemplateDB) ([]*TemplateVersionDB, error) {
+	versions, err := listTemplateVersion(template)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 1 && versions[0].Id == "" {
+		version, err := insertTemplateVersion(template, "", 1, true)
+		if err == errTemplateVersionConflict {
+			// 其他副本已经保存了第一个版本
+			return listTemplateVersion(template)
+		} else if err != nil {
+			return nil, err
+		}
+		versions[0] = version
+	}
+	return versions, nil
+}
+
+// 修改默认版本，同时把模板表中的spec替换为默认版本的spec
+func setDefaultTemplateVersion(template *common.TemplateDB, versions []*TemplateVersionDB, target *TemplateVersionDB) error {
+	for _, version := range versions {
+		if version.Default && version.Id != target.Id {
+			version.Default = false
+			if err := db.Update(TemplateVersionTable, version.Id, version); err != nil {
+				return err
+			}
+		}
+	}
+	if !target.Default {
+		target.Default = true
+		if err := db.Update(TemplateVersionTable, target.Id, target); err != nil {
+			return err
+		}
+	}
+	template.Spec = target.Spec
+	template.Describe = target.Describe
+	template.ModifyTime = time.Now().Unix()
+	return db.Update(common.TemplateTable, template.Id, template)
+}
+
+func (r *TemplateVersionResource) template() (*common.TemplateDB, error) {
+	template := &common.TemplateDB{}
+	if err := db.GetById(common.TemplateTable, r.Params.Name, template); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// 模板的版本列表，不包含spec
+func (r *TemplateVersionResource) List() ([]*TemplateVersionDB, error) {
+	template, err := r.template()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := listTemplateVersion(template)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		version.Spec = nil
+	}
+	return versions, nil
+}
+
+// version为0时返回默认版本
+func (r *TemplateVersionResource) Get(number int) (*TemplateVersionDB, error) {
+	template, err := r.template()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := listTemplateVersion(template)
+	if err != nil {
+		return nil, err
+	}
+	return findTemplateVersion(versions, number)
+}
+
+// 比较两个版本，to为0时和默认版本比较
+func (r *TemplateVersionResource) Diff(from, to int) (*TemplateVersionDiffResult, error) {
+	template, err := r.template()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := listTemplateVersion(template)
+	if err != nil {
+		return nil, err
+	}
+	fromVersion, err := findTemplateVersion(versions, from)
+	if err != nil {
+		return nil, err
+	}
+	toVersion, err := findTemplateVersion(versions, to)
+	if err != nil {
+		return nil, err
+	}
+	fromValue, err := templateSpecValue(fromVersion.Spec)
+	if err != nil {
+		return nil, err
+	}
+	toValue, err := templateSpecValue(toVersion.Spec)
+	if err != nil {
+		return nil, err
+	}
+	changes := make([]TemplateChange, 0)
+	diffTemplateValue("", fromValue, toValue, &changes)
+	// 返回的版本信息不包含spec
+	fromVersion.Spec, toVersion.Spec = nil, nil
+	return &TemplateVersionDiffResult{From: fromVersion, To: toVersion, Changes: changes}, nil
+}
+
+func (r *TemplateVersionResource) SetDefault(number int) (*TemplateVersionDB, error) {
+	if number == 0 {
+		return nil, errors.New("version cannot be empty")
+	}
+	templateVersionLock.Lock()
+	defer templateVersionLock.Unlock()
+	template, err := r.template()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := backfillTemplateVersion(template)
+	if err != nil {
+		return nil, err
+	}
+	target, err := findTemplateVersion(versions, number)
+	if err != nil {
+		return nil, err
+	}
+	if err := setDefaultTemplateVersion(template, versions, target); err != nil {
+		return nil, err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Template,
+		ActionType: TemplateVersionDefault,
+		Resources:  r.Params,
+		Name:       template.Name,
+		PostData:   map[string]interface{}{"template": template.Id, "version": target.Version},
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return nil, err
+	}
+	target.Spec = nil
+	return target, nil
+}
+
+func findTemplateVersion(versions []*TemplateVersionDB, number int) (*TemplateVersionDB, error) {
+	for _, version := range versions {
+		if (number == 0 && version.Default) || (number != 0 && version.Version == number) {
+			return version, nil
+		}
+	}
+	if number == 0 {
+		return nil, errors.New("default version not found")
+	}
+	return nil, fmt.Errorf("version %d not found", number)
+}
+
+// 按RFC 6901转义路径中的键和名称，~转义为~0，/转义为~1
+var pathSegmentReplacer = strings.NewReplacer("~", "~0", "/", "~1")
+
+func escapePathSegment(segment string) string {
+	return pathSegmentReplacer.Replace(segment)
+}
+
+// 递归比较JSON，元素都带有name的数组(容器、环境变量、端口等)按name匹配，其它数组按下标匹配
+func diffTemplateValue(path string, from, to interface{}, changes *[]TemplateChange) {
+	switch f := from.(type) {
+	case map[string]interface{}:
+		if t, ok := to.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(f)+len(t))
+			for k := range f {
+				keys = append(keys, k)
+			}
+			for k := range t {
+				if _, ok := f[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fv, fok := f[k]
+				tv, tok := t[k]
+				switch {
+				case !fok:
+					*changes = append(*changes, TemplateChange{Path: path + "/" + escapePathSegment(k), Op: "add", To: tv})
+				case !tok:
+					*changes = append(*changes, TemplateChange{Path: path + "/" + escapePathSegment(k), Op: "remove", From: fv})
+				default:
+					diffTemplateValue(path+"/"+escapePathSegment(k), fv, tv, changes)
+				}
+			}
+			return
+		}
+	case []interface{}:
+		if t, ok := to.([]interface{}); ok {
+			fromNames, fok := namedElements(f)
+			toNames, tok := namedElements(t)
+			if fok && tok {
+				for _, v := range f {
+					name := v.(map[string]interface{})["name"].(string)
+					if tv, ok := toNames[name]; ok {
+						diffTemplateValue(path+"/"+escapePathSegment(name), v, tv, changes)
+					} else {
+						*changes = append(*changes, TemplateChange{Path: path + "/" + escapePathSegment(name), Op: "remove", From: v})
+					}
+				}
+				for _, v := range t {
+					name := v.(map[string]interface{})["name"].(string)
+					if _, ok := fromNames[name]; !ok {
+						*changes = append(*changes, TemplateChange{Path: path + "/" + escapePathSegment(name), Op: "add", To: v})
+					}
+				}
+				return
+			}
+			for i := 0; i < len(f) || i < len(t); i++ {
+				p := path + "/" + strconv.Itoa(i)
+				switch {
+				case i >= len(t):
+					*changes = append(*changes, TemplateChange{Path: p, Op: "remove", From: f[i]})
+				case i >= len(f):
+					*changes = append(*changes, TemplateChange{Path: p, Op: "add", To: t[i]})
+				default:
+					diffTemplateValue(p, f[i], t[i], changes)
+				}
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, TemplateChange{Path: path, Op: "replace", From: from, To: to})
+	}
+}
+
+func namedElements(values []interface{}) (map[string]interface{}, bool) {
+	names := make(map[string]interface{}, len(values))
+	for _, v := range values {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		name, ok := m["name"].(string)
+		if !ok {
+			return nil, false
+		}
+		if _, ok := names[name]; ok {
+			return nil, false
+		}
+		names[name] = v
+	}
+	return names, true
+}
+
+// 把模板内容转换为通用的JSON结构
+func templateSpecValue(spec interface{}) (interface{}, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal(data, &value)
+	return value, err
+}
@@ -0,0 +1,91 @@
+package resource
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffTemplateValue(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want []TemplateChange
+	}{
+		{"equal", `{"replicas":1,"containers":[{"name":"app","image":"nginx:1"}]}`, `{"replicas":1,"containers":[{"name":"app","image":"nginx:1"}]}`, []TemplateChange{}},
+		{"replace", `{"replicas":1}`, `{"replicas":2}`, []TemplateChange{
+			{Path: "/replicas", Op: "replace", From: 1.0, To: 2.0},
+		}},
+		// 对象的键按名称排序输出
+		{"add and remove keys", `{"b":1,"c":2}`, `{"a":3,"c":2}`, []TemplateChange{
+			{Path: "/a", Op: "add", To: 3.0},
+			{Path: "/b", Op: "remove", From: 1.0},
+		}},
+		// 带有name的数组按name匹配，顺序变化不算修改
+		{"named elements", `{"containers":[{"name":"app","image":"nginx:1"},{"name":"sidecar","image":"envoy"}]}`,
+			`{"containers":[{"name":"log","image":"fluentd"},{"name":"app","image":"nginx:2"}]}`, []TemplateChange{
+				{Path: "/containers/app/image", Op: "replace", From: "nginx:1", To: "nginx:2"},
+				{Path: "/containers/sidecar", Op: "remove", From: map[string]interface{}{"name": "sidecar", "image": "envoy"}},
+				{Path: "/containers/log", Op: "add", To: map[string]interface{}{"name": "log", "image": "fluentd"}},
+			}},
+		{"indexed elements", `{"args":["a","b"]}`, `{"args":["a","c","d"]}`, []TemplateChange{
+			{Path: "/args/1", Op: "replace", From: "b", To: "c"},
+			{Path: "/args/2", Op: "add", To: "d"},
+		}},
+		{"indexed elements removed", `{"args":["a","b"]}`, `{"args":["a"]}`, []TemplateChange{
+			{Path: "/args/1", Op: "remove", From: "b"},
+		}},
+		// name重复时无法按name匹配，按下标比较
+		{"duplicate names", `{"env":[{"name":"A","value":"1"},{"name":"A","value":"2"}]}`, `{"env":[{"name":"A","value":"1"},{"name":"A","value":"3"}]}`, []TemplateChange{
+			{Path: "/env/1/value", Op: "replace", From: "2", To: "3"},
+		}},
+		// 键和名称中的~和/按RFC 6901转义
+		{"escaped segments", `{"annotations":{"kingfisher.io/rollout":"a"},"volumes":[{"name":"data~/tmp","path":"/a"}]}`,
+			`{"annotations":{"kingfisher.io/rollout":"b"},"volumes":[{"name":"data~/tmp","path":"/b"}]}`, []TemplateChange{
+				{Path: "/annotations/kingfisher.io~1rollout", Op: "replace", From: "a", To: "b"},
+				{Path: "/volumes/data~0~1tmp/path", Op: "replace", From: "/a", To: "/b"},
+			}},
+		{"type changed", `{"resources":{"limits":{"cpu":"1"}}}`, `{"resources":"none"}`, []TemplateChange{
+			{Path: "/resources", Op: "replace", From: map[string]interface{}{"limits": map[string]interface{}{"cpu": "1"}}, To: "none"},
+		}},
+	}
+	for _, test := range tests {
+		var from, to interface{}
+		if err := json.Unmarshal([]byte(test.from), &from); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(test.to), &to); err != nil {
+			t.Fatal(err)
+		}
+		changes := make([]TemplateChange, 0)
+		diffTemplateValue("", from, to, &changes)
+		if !reflect.DeepEqual(changes, test.want) {
+			t.Errorf("%s: diffTemplateValue() = %+v, want %+v", test.name, changes, test.want)
+		}
+	}
+}
+
+func TestFindTemplateVersion(t *testing.T) {
+	versions := []*TemplateVersionDB{{Version: 3}, {Version: 2, Default: true}, {Version: 1}}
+	tests := []struct {
+		number  int
+		want    int
+		wantErr bool
+	}{
+		{0, 2, false},
+		{3, 3, false},
+		{1, 1, false},
+		{4, 0, true},
+	}
+	for _, test := range tests {
+		version, err := findTemplateVersion(versions, test.number)
+		if (err != nil) != test.wantErr {
+			t.Errorf("findTemplateVersion(%d) error = %v, wantErr %v", test.number, err, test.wantErr)
+			continue
+		}
+		if err == nil && version.Version != test.want {
+			t.Errorf("findTemplateVersion(%d) = %d, want %d", test.number, version.Version, test.want)
+		}
+	}
+}
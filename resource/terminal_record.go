@@ -0,0 +1,220 @@
+package resource
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/common/log"
+	"github.com/open-kingfisher/king-utils/kit"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// 终端录像保存目录，每个会话保存<id>.cast录像文件和<id>.json会话信息
+	TerminalRecordPath = "/var/log/kingfisher/terminal/"
+	TerminalWidth      = 80
+	TerminalHeight     = 24
+)
+
+// 终端会话信息
+type TerminalRecord struct {
+	Id        string `json:"id"`
+	User      string `json:"user"`
+	Cluster   string `json:"cluster"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Timestamp int64  `json:"timestamp"`
+	Duration  int64  `json:"duration"`
+}
+
+// https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+type asciicastHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title"`
+	Env       map[string]string `json:"env"`
+}
+
+// 以asciicast v2格式录制终端会话的输入、输出以及窗口大小变化
+type TerminalRecorder struct {
+	mu      sync.Mutex
+	record  *TerminalRecord
+	file    *os.File
+	start   time.Time
+	pending map[string][]byte
+}
+
+func NewTerminalRecorder(record *TerminalRecord) (*TerminalRecorder, error) {
+	if err := os.MkdirAll(TerminalRecordPath, 0755); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	record.Id = kit.UUID("r")
+	record.Timestamp = start.Unix()
+	file, err := os.Create(filepath.Join(TerminalRecordPath, record.Id+".cast"))
+	if err != nil {
+		return nil, err
+	}
+	t := &TerminalRecorder{
+		record:  record,
+		file:    file,
+		start:   start,
+		pending: make(map[string][]byte),
+	}
+	header, err := json.Marshal(asciicastHeader{
+		Version:   2,
+		Width:     TerminalWidth,
+		Height:    TerminalHeight,
+		Timestamp: record.Timestamp,
+		Title:     fmt.Sprintf("%s@%s/%s/%s/%s", record.User, record.Cluster, record.Namespace, record.Pod, record.Container),
+		Env:       map[string]string{"TERM": "xterm"},
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Write(append(header, '\n')); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := t.saveRecord(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TerminalRecorder) Output(p []byte) {
+	t.writeEvent("o", p)
+}
+
+func (t *TerminalRecorder) Input(p []byte) {
+	t.writeEvent("i", p)
+}
+
+func (t *TerminalRecorder) Resize(width, height uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writeLine("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// 关闭录像文件并更新会话时长
+func (t *TerminalRecorder) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record.Duration = int64(time.Since(t.start).Seconds())
+	if err := t.saveRecord(); err != nil {
+		log.Errorf("Save terminal record error:%s; Id:%s", err, t.record.Id)
+	}
+	return t.file.Close()
+}
+
+// 输出可能在多字节字符中间被截断，不完整的字符留到下一次再写入
+func (t *TerminalRecorder) writeEvent(code string, p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	data := append(t.pending[code], p...)
+	n := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				n = i
+			}
+			break
+		}
+	}
+	t.pending[code] = append([]byte(nil), data[n:]...)
+	if n > 0 {
+		t.writeLine(code, string(data[:n]))
+	}
+}
+
+func (t *TerminalRecorder) writeLine(code, data string) {
+	line, err := json.Marshal([]interface{}{time.Since(t.start).Seconds(), code, data})
+	if err != nil {
+		return
+	}
+	if _, err := t.file.Write(append(line, '\n')); err != nil {
+		log.Errorf("Write terminal record error:%s; Id:%s", err, t.record.Id)
+	}
+}
+
+func (t *TerminalRecorder) saveRecord() error {
+	data, err := json.Marshal(t.record)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(TerminalRecordPath, t.record.Id+".json"), data, 0644)
+}
+
+type TerminalRecordResource struct {
+	Params *handle.Resources
+	Pod    string
+	User   string
+}
+
+// 按照集群、命名空间、Pod、用户查询终端录像，按时间倒序
+func (r *TerminalRecordResource) List() ([]*TerminalRecord, error) {
+	records := make([]*TerminalRecord, 0)
+	files, err := filepath.Glob(filepath.Join(TerminalRecordPath, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		record, err := readTerminalRecord(file)
+		if err != nil {
+			log.Errorf("Read terminal record error:%s; File:%s", err, file)
+			continue
+		}
+		if record.Cluster != r.Params.Cluster || record.Namespace != r.Params.Namespace {
+			continue
+		}
+		if (r.Pod != "" && record.Pod != r.Pod) || (r.User != "" && record.User != r.User) {
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Timestamp > records[j].Timestamp
+	})
+	return records, nil
+}
+
+func (r *TerminalRecordResource) Get() (*TerminalRecord, error) {
+	if r.Params.Name == "" || strings.ContainsAny(r.Params.Name, `/\.`) {
+		return nil, errors.New("invalid terminal record id")
+	}
+	return readTerminalRecord(filepath.Join(TerminalRecordPath, r.Params.Name+".json"))
+}
+
+// 录像文件路径，用于回放
+func (r *TerminalRecordResource) CastFile() (string, error) {
+	record, err := r.Get()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(TerminalRecordPath, record.Id+".cast"), nil
+}
+
+func readTerminalRecord(file string) (*TerminalRecord, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	record := &TerminalRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
@@ -0,0 +1,90 @@
+package resource
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTerminalRecorderWriteEvent(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   []string
+	}{
+		{"ascii", []string{"ls\r\n", "a b\r\n"}, []string{"ls\r\n", "a b\r\n"}},
+		// "你"为e4 bd a0，"好"为e5 a5 bd
+		{"split rune", []string{"\xe4\xbd", "\xa0\xe5", "\xa5\xbd!"}, []string{"你", "好!"}},
+		{"split at first byte", []string{"ok\xe4", "\xbd\xa0"}, []string{"ok", "你"}},
+		{"whole runes", []string{"你好"}, []string{"你好"}},
+	}
+	for _, test := range tests {
+		file, err := ioutil.TempFile("", "terminal-record")
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := &TerminalRecorder{
+			record:  &TerminalRecord{},
+			file:    file,
+			start:   time.Now(),
+			pending: make(map[string][]byte),
+		}
+		for _, chunk := range test.chunks {
+			recorder.Output([]byte(chunk))
+		}
+		file.Close()
+		got := readRecordEvents(t, file.Name())
+		os.Remove(file.Name())
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: events = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// 输入和输出分别缓存不完整的字符
+func TestTerminalRecorderPendingPerCode(t *testing.T) {
+	file, err := ioutil.TempFile("", "terminal-record")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	recorder := &TerminalRecorder{
+		record:  &TerminalRecord{},
+		file:    file,
+		start:   time.Now(),
+		pending: make(map[string][]byte),
+	}
+	recorder.Output([]byte("\xe4\xbd"))
+	recorder.Input([]byte("q"))
+	recorder.Output([]byte("\xa0"))
+	file.Close()
+	got := readRecordEvents(t, file.Name())
+	if want := []string{"q", "你"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func readRecordEvents(t *testing.T, name string) []string {
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	events := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid event %q: %s", scanner.Text(), err)
+		}
+		if len(event) != 3 {
+			t.Fatalf("invalid event %q", scanner.Text())
+		}
+		events = append(events, event[2].(string))
+	}
+	return events
+}
@@ -0,0 +1,415 @@
+package resource
+
+import (
+	"errors"
+	"fmt"
+	"github.com/open-kingfisher/king-utils/common"
+	"github.com/open-kingfisher/king-utils/common/handle"
+	"github.com/open-kingfisher/king-utils/kit"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/transport/spdy"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	TerminalKill    = common.ActionType("terminal_kill")
+	TerminalApprove = common.ActionType("terminal_approve")
+	// 共享会话的只读和读写模式
+	TerminalReadOnly  = "read"
+	TerminalReadWrite = "write"
+)
+
+// 终端会话的超时时间以及并发限制，可以通过启动参数修改，0表示不限制
+var (
+	TerminalIdleTimeout  = 30 * time.Minute
+	TerminalMaxDuration  = 8 * time.Hour
+	TerminalUserLimit    = 5
+	TerminalClusterLimit = 100
+)
+
+// 正在运行的终端会话
+var terminalSessions = struct {
+	sync.Mutex
+	sessions map[string]*TerminalSession
+}{sessions: make(map[string]*TerminalSession)}
+
+type TerminalSession struct {
+	Id         string `json:"id"`
+	User       string `json:"user"`
+	Cluster    string `json:"cluster"`
+	Namespace  string `json:"namespace"`
+	Pod        string `json:"pod"`
+	Container  string `json:"container"`
+	RemoteAddr string `json:"remoteAddr"`
+	StartTime  int64  `json:"startTime"`
+	LastActive int64  `json:"lastActive"`
+	// 共享会话的参与者
+	Viewers    []*TerminalViewer `json:"viewers"`
+	mu         sync.Mutex
+	start      time.Time
+	lastActive time.Time
+	reason     string
+	conn       httpstream.Connection
+	input      chan TerminalInput
+	done       chan struct{}
+	viewers    map[string]*TerminalViewer
+}
+
+// 终端输入，Resize为true时表示窗口大小变化
+type TerminalInput struct {
+	Data   []byte
+	Resize bool
+	Width  uint16
+	Height uint16
+}
+
+// 共享会话的参与者，读写模式需要会话所有者批准后才能输入
+type TerminalViewer struct {
+	Id       string `json:"id"`
+	User     string `json:"user"`
+	Mode     string `json:"mode"`
+	Approved bool   `json:"approved"`
+	JoinTime int64  `json:"joinTime"`
+	output   chan []byte
+}
+
+// 参与者的终端输出，会话结束或者参与者离开时关闭
+func (v *TerminalViewer) Output() <-chan []byte {
+	return v.output
+}
+
+// 注册终端会话，超过用户或者集群的并发限制时返回错误
+func NewTerminalSession(session *TerminalSession) (*TerminalSession, error) {
+	terminalSessions.Lock()
+	defer terminalSessions.Unlock()
+	var userCount, clusterCount int
+	for _, s := range terminalSessions.sessions {
+		if s.User == session.User {
+			userCount++
+		}
+		if s.Cluster == session.Cluster {
+			clusterCount++
+		}
+	}
+	if TerminalUserLimit > 0 && userCount >= TerminalUserLimit {
+		return nil, fmt.Errorf("user %s has reached the limit of %d terminal sessions", session.User, TerminalUserLimit)
+	}
+	if TerminalClusterLimit > 0 && clusterCount >= TerminalClusterLimit {
+		return nil, fmt.Errorf("cluster has reached the limit of %d terminal sessions", TerminalClusterLimit)
+	}
+	session.Id = kit.UUID("t")
+	session.start = time.Now()
+	session.lastActive = session.start
+	session.input = make(chan TerminalInput, 64)
+	session.done = make(chan struct{})
+	session.viewers = make(map[string]*TerminalViewer)
+	terminalSessions.sessions[session.Id] = session
+	return session, nil
+}
+
+// 用户有输入时更新最后活跃时间
+func (s *TerminalSession) Touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive = time.Now()
+}
+
+// 空闲超时和最长时间中先到的一个，零值表示没有期限
+func (s *TerminalSession) Deadline() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deadline time.Time
+	if TerminalIdleTimeout > 0 {
+		deadline = s.lastActive.Add(TerminalIdleTimeout)
+	}
+	if TerminalMaxDuration > 0 {
+		if max := s.start.Add(TerminalMaxDuration); deadline.IsZero() || max.Before(deadline) {
+			deadline = max
+		}
+	}
+	return deadline
+}
+
+// 超时原因，空闲超时或者超过最长时间
+func (s *TerminalSession) TimeoutReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if TerminalMaxDuration > 0 && !time.Now().Before(s.start.Add(TerminalMaxDuration)) {
+		return fmt.Sprintf("maximum session duration %s exceeded", TerminalMaxDuration)
+	}
+	return fmt.Sprintf("idle timeout %s exceeded", TerminalIdleTimeout)
+}
+
+// 终止会话，关闭到容器的SPDY连接使终端退出，reason为空表示正常退出
+func (s *TerminalSession) Terminate(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+		for id, viewer := range s.viewers {
+			close(viewer.output)
+			delete(s.viewers, id)
+		}
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// 会话终止后关闭
+func (s *TerminalSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// 会话所有者以及读写参与者的输入
+func (s *TerminalSession) Input() <-chan TerminalInput {
+	return s.input
+}
+
+func (s *TerminalSession) Send(input TerminalInput) {
+	select {
+	case s.input <- input:
+	case <-s.done:
+	}
+}
+
+// 终端输出同步给所有参与者，参与者接收过慢时丢弃输出，避免阻塞终端
+func (s *TerminalSession) Broadcast(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, viewer := range s.viewers {
+		select {
+		case viewer.output <- append([]byte(nil), p...):
+		default:
+		}
+	}
+}
+
+// 加入共享会话
+func (s *TerminalSession) Join(user, mode string) (*TerminalViewer, error) {
+	if mode != TerminalReadWrite {
+		mode = TerminalReadOnly
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil, errors.New("terminal session has ended")
+	default:
+	}
+	viewer := &TerminalViewer{
+		Id:       kit.UUID("v"),
+		User:     user,
+		Mode:     mode,
+		JoinTime: time.Now().Unix(),
+		output:   make(chan []byte, 256),
+	}
+	s.viewers[viewer.Id] = viewer
+	return viewer, nil
+}
+
+// 离开共享会话
+func (s *TerminalSession) Leave(viewer *TerminalViewer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.viewers[viewer.Id]; ok {
+		close(viewer.output)
+		delete(s.viewers, viewer.Id)
+	}
+}
+
+// 参与者的输入，只有被批准的读写参与者可以输入
+func (s *TerminalSession) ViewerInput(viewer *TerminalViewer, data []byte) error {
+	s.mu.Lock()
+	allowed := viewer.Mode == TerminalReadWrite && viewer.Approved
+	s.mu.Unlock()
+	if !allowed {
+		return errors.New("write access has not been approved")
+	}
+	s.Touch()
+	s.Send(TerminalInput{Data: data})
+	return nil
+}
+
+// 批准或者撤销参与者的写权限
+func (s *TerminalSession) Approve(viewerId string, approved bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	viewer, ok := s.viewers[viewerId]
+	if !ok {
+		return errors.New("viewer does not exist")
+	}
+	if viewer.Mode != TerminalReadWrite {
+		return errors.New("viewer did not request write access")
+	}
+	viewer.Approved = approved
+	return nil
+}
+
+// 会话被终止的原因，未被终止时为空
+func (s *TerminalSession) Reason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reason
+}
+
+// 会话结束后注销，并断开所有参与者
+func (s *TerminalSession) Close() {
+	terminalSessions.Lock()
+	delete(terminalSessions.sessions, s.Id)
+	terminalSessions.Unlock()
+	s.Terminate("")
+}
+
+// 根据会话ID获取正在运行的终端会话
+func GetTerminalSession(id string) (*TerminalSession, error) {
+	terminalSessions.Lock()
+	defer terminalSessions.Unlock()
+	session, ok := terminalSessions.sessions[id]
+	if !ok {
+		return nil, errors.New("terminal session does not exist")
+	}
+	return session, nil
+}
+
+// 包装SPDY Upgrader，记录建立的连接用于终止会话
+func (s *TerminalSession) Upgrader(upgrader spdy.Upgrader) spdy.Upgrader {
+	return &sessionUpgrader{upgrader: upgrader, session: s}
+}
+
+type sessionUpgrader struct {
+	upgrader spdy.Upgrader
+	session  *TerminalSession
+}
+
+func (u *sessionUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := u.upgrader.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+	u.session.mu.Lock()
+	defer u.session.mu.Unlock()
+	select {
+	case <-u.session.done:
+		conn.Close()
+		return nil, errors.New("terminal session has ended")
+	default:
+	}
+	u.session.conn = conn
+	return conn, nil
+}
+
+func (s *TerminalSession) snapshot() *TerminalSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	viewers := make([]*TerminalViewer, 0, len(s.viewers))
+	for _, v := range s.viewers {
+		viewers = append(viewers, &TerminalViewer{Id: v.Id, User: v.User, Mode: v.Mode, Approved: v.Approved, JoinTime: v.JoinTime})
+	}
+	sort.Slice(viewers, func(i, j int) bool {
+		return viewers[i].JoinTime < viewers[j].JoinTime
+	})
+	return &TerminalSession{
+		Id:         s.Id,
+		User:       s.User,
+		Cluster:    s.Cluster,
+		Namespace:  s.Namespace,
+		Pod:        s.Pod,
+		Container:  s.Container,
+		RemoteAddr: s.RemoteAddr,
+		StartTime:  s.start.Unix(),
+		LastActive: s.lastActive.Unix(),
+		Viewers:    viewers,
+	}
+}
+
+type TerminalSessionResource struct {
+	Params *handle.Resources
+	// 平台管理员可以查看和终止所有会话，其他用户只能查看自己的会话
+	Admin    bool
+	Viewer   string
+	Approved bool
+}
+
+// 列出正在运行的终端会话，指定集群时只列出该集群的会话
+func (r *TerminalSessionResource) List() ([]*TerminalSession, error) {
+	terminalSessions.Lock()
+	defer terminalSessions.Unlock()
+	sessions := make([]*TerminalSession, 0, len(terminalSessions.sessions))
+	for _, s := range terminalSessions.sessions {
+		if !r.Admin && s.User != r.userName() {
+			continue
+		}
+		if r.Params.Cluster != "" && s.Cluster != r.Params.Cluster {
+			continue
+		}
+		if r.Params.Namespace != "" && s.Namespace != r.Params.Namespace {
+			continue
+		}
+		sessions = append(sessions, s.snapshot())
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartTime < sessions[j].StartTime
+	})
+	return sessions, nil
+}
+
+// 强制终止终端会话
+func (r *TerminalSessionResource) Delete() error {
+	if !r.Admin {
+		return errors.New("administrator permission required")
+	}
+	session, err := GetTerminalSession(r.Params.Name)
+	if err != nil {
+		return err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Pod,
+		ActionType: TerminalKill,
+		Resources:  r.Params,
+		Name:       session.Pod,
+		PostData:   session.snapshot(),
+	}
+	if err := auditLog.InsertAuditLog(); err != nil {
+		return err
+	}
+	session.Terminate(fmt.Sprintf("terminated by administrator %s", r.userName()))
+	return nil
+}
+
+// 会话所有者批准或者撤销参与者的写权限
+func (r *TerminalSessionResource) Approve() error {
+	session, err := GetTerminalSession(r.Params.Name)
+	if err != nil {
+		return err
+	}
+	if !r.Admin && session.User != r.userName() {
+		return errors.New("only the session owner can approve write access")
+	}
+	if err := session.Approve(r.Viewer, r.Approved); err != nil {
+		return err
+	}
+	auditLog := handle.AuditLog{
+		Kind:       common.Pod,
+		ActionType: TerminalApprove,
+		Resources:  r.Params,
+		Name:       session.Pod,
+		PostData:   map[string]interface{}{"session": session.Id, "viewer": r.Viewer, "approved": r.Approved},
+	}
+	return auditLog.InsertAuditLog()
+}
+
+func (r *TerminalSessionResource) userName() string {
+	if r.Params.User == nil {
+		return ""
+	}
+	return r.Params.User.Name
+}
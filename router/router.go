@@ -5,7 +5,6 @@ import (
 	"github.com/open-kingfisher/king-k8s/impl"
 	"github.com/open-kingfisher/king-utils/common"
 	jwtAuth "github.com/open-kingfisher/king-utils/middleware/jwt"
-	"golang.org/x/net/websocket"
 	"net/http"
 )
 
@@ -13,11 +12,20 @@ func SetupRouter(r *gin.Engine) *gin.Engine {
 	//重新定义404
 	r.NoRoute(NoRoute)
 
-	// web terminal
-	r.GET(common.K8SPath+"terminal", func(c *gin.Context) {
-		impl := websocket.Handler(impl.Terminal)
-		impl.ServeHTTP(c.Writer, c.Request)
-	})
+	// websocket (web terminal, log stream)，握手前校验Token以及命名空间权限
+	webSocket := r.Group("/", impl.WebSocketAuth())
+	{
+		// web terminal
+		webSocket.GET(common.K8SPath+"terminal", impl.ServeWebSocket(impl.Terminal))
+		// join a shared terminal session
+		webSocket.GET(common.K8SPath+"terminalShare", impl.ServeWebSocket(impl.JoinTerminal))
+		// pod log stream
+		webSocket.GET(common.K8SPath+"podLog", impl.ServeWebSocket(impl.PodLog))
+		// controller (Deployment DaemonSet StatefulSet) log stream
+		webSocket.GET(common.K8SPath+"controllerLog", impl.ServeWebSocket(impl.ControllerLog))
+		// pod / service port forward
+		webSocket.GET(common.K8SPath+"portForward", impl.ServeWebSocket(impl.PortForward))
+	}
 
 	authorize := r.Group("/", jwtAuth.JWTAuth())
 	{
@@ -28,6 +36,8 @@ func SetupRouter(r *gin.Engine) *gin.Engine {
 		authorize.PUT(common.K8SPath+"nodes/:name", impl.UpdateNode)
 		authorize.POST(common.K8SPath+"nodes", impl.CreateNode)
 		authorize.PATCH(common.K8SPath+"nodes/:name", impl.PatchNode)
+		// node shell (privileged nsenter pod)
+		authorize.POST(common.K8SPath+"nodes/:name/shell", impl.ShellNode)
 		authorize.GET(common.K8SPath+"listPodByNode/:name", impl.ListPodByNode)
 		authorize.GET(common.K8SPath+"nodeMetric/:name", impl.NodeMetric)
 
@@ -47,15 +57,39 @@ func SetupRouter(r *gin.Engine) *gin.Engine {
 		authorize.GET(common.K8SPath+"pod/:name/debug", impl.DebugPod)
 		// pod 救援模式
 		authorize.POST(common.K8SPath+"pod/:name/rescue", impl.RescuePod)
+		// 非交互式执行命令
+		authorize.POST(common.K8SPath+"pod/:name/exec", impl.ExecPod)
+		// 容器文件上传下载
+		authorize.GET(common.K8SPath+"pod/:name/file", impl.DownloadPodFile)
+		authorize.POST(common.K8SPath+"pod/:name/file", impl.UploadPodFile)
+		// 容器网络抓包
+		authorize.POST(common.K8SPath+"pod/:name/capture", impl.CapturePod)
 		authorize.DELETE(common.K8SPath+"pod/:name", impl.DeletePod)
 		authorize.PATCH(common.K8SPath+"pod/patch/:name", impl.PatchPod)
 		authorize.PATCH(common.K8SPath+"pod/evict/:name", impl.EvictPod)
 		authorize.GET(common.K8SPath+"kubectl/install", impl.KubectlPod)
 		authorize.GET(common.K8SPath+"kubectl/uninstall", impl.UnKubectlPod)
 		authorize.GET(common.K8SPath+"debug/podIP/:name", impl.GetDebugPodIPByPod)
+		// debug / rescue / node shell session (list, extend ttl, teardown)
+		authorize.GET(common.K8SPath+"debugSession", impl.ListDebugSession)
+		authorize.PATCH(common.K8SPath+"debugSession/:name", impl.ExtendDebugSession)
+		authorize.DELETE(common.K8SPath+"debugSession/:name", impl.DeleteDebugSession)
 		authorize.PATCH(common.K8SPath+"pod/offline/:name", impl.OfflinePod)
 		authorize.PATCH(common.K8SPath+"pod/online/:name", impl.OnlinePod)
 
+		// terminal record
+		authorize.GET(common.K8SPath+"terminalRecord", impl.ListTerminalRecord)
+		authorize.GET(common.K8SPath+"terminalRecord/:name", impl.ReplayTerminalRecordFile)
+		// terminal session (list, kill, approve shared write access)
+		authorize.GET(common.K8SPath+"terminalSession", impl.ListTerminalSession)
+		authorize.DELETE(common.K8SPath+"terminalSession/:name", impl.DeleteTerminalSession)
+		authorize.PATCH(common.K8SPath+"terminalSession/:name/viewer/:viewer", impl.ApproveTerminalViewer)
+
+		// log bundle (tar.gz)
+		authorize.GET(common.K8SPath+"logBundle/pod/:name", impl.PodLogBundle)
+		authorize.GET(common.K8SPath+"logBundle/controller/:controller/:name", impl.ControllerLogBundle)
+		authorize.GET(common.K8SPath+"logBundle/namespace", impl.NamespaceLogBundle)
+
 		// service
 		authorize.GET(common.K8SPath+"service", impl.ListService)
 		authorize.GET(common.K8SPath+"service/:name", impl.GetService)
@@ -94,14 +128,40 @@ func SetupRouter(r *gin.Engine) *gin.Engine {
 		authorize.PATCH(common.K8SPath+"controller/:controller/step/resume/:name", impl.UpdatePatchStepResumeController)
 		authorize.PATCH(common.K8SPath+"controller/:controller/all/resume/:name", impl.UpdatePatchAllResumeController)
 		authorize.PATCH(common.K8SPath+"controller/:controller/pause/:name", impl.UpdatePatchPauseController)
+		authorize.PATCH(common.K8SPath+"controller/:controller/abort/:name", impl.AbortControllerRollout)
+		authorize.POST(common.K8SPath+"controller/:controller/canary/:name", impl.CanaryController)
+		authorize.POST(common.K8SPath+"controller/:controller/blueGreen/:name", impl.BlueGreenController)
 		authorize.PATCH(common.K8SPath+"controller/:controller/watch/:name", impl.WatchPodIPController)
-		// 接口调用报错
-		//authorize.PATCH(common.K8SPath+"controller/:controller/scale/:name", impl.ScaleController)
+		authorize.PATCH(common.K8SPath+"controller/:controller/scale/:name", impl.ScaleController)
+		authorize.PATCH(common.K8SPath+"controller/:controller/revertScale/:name", impl.RevertScaleController)
 		authorize.POST(common.K8SPath+"controller", impl.CreateController)
+		// 多文档YAML使用server-side apply创建或更新
+		authorize.POST(common.K8SPath+"apply", impl.ApplyManifest)
 		authorize.PUT(common.K8SPath+"controller/:controller", impl.UpdateController)
 
 		authorize.GET(common.K8SPath+"controllerChart/:controller/:name", impl.GetControllerChart)
+		// 分步上线记录
+		authorize.GET(common.K8SPath+"controllerRollout/:controller/:name", impl.ListControllerRollout)
+		authorize.GET(common.K8SPath+"controllerRollout/:controller/:name/:id", impl.GetControllerRollout)
+		// 定时扩缩容
+		authorize.GET(common.K8SPath+"scaleSchedule", impl.ListScaleSchedule)
+		authorize.GET(common.K8SPath+"scaleSchedule/:name", impl.GetScaleSchedule)
+		authorize.POST(common.K8SPath+"scaleSchedule", impl.CreateScaleSchedule)
+		authorize.PUT(common.K8SPath+"scaleSchedule/:name", impl.UpdateScaleSchedule)
+		authorize.DELETE(common.K8SPath+"scaleSchedule/:name", impl.DeleteScaleSchedule)
+		// 版本历史、版本对比以及回滚
+		authorize.GET(common.K8SPath+"controllerHistory/:controller/:name", impl.ListControllerHistory)
+		authorize.GET(common.K8SPath+"controllerHistory/:controller/:name/diff", impl.DiffControllerHistory)
+		authorize.POST(common.K8SPath+"controller/:controller/rollback/:name", impl.RollbackController)
 		authorize.PUT(common.K8SPath+"template/:controller/:name", impl.SaveAsTemplate)
+		// 从模板创建控制器，name为模板Id
+		authorize.POST(common.K8SPath+"templateDeploy/:name/preview", impl.PreviewTemplateDeploy)
+		authorize.POST(common.K8SPath+"templateDeploy/:name", impl.TemplateDeploy)
+		// 模板版本，name为模板Id
+		authorize.GET(common.K8SPath+"templateVersion/:name", impl.ListTemplateVersion)
+		authorize.GET(common.K8SPath+"templateVersion/:name/:version", impl.GetTemplateVersion)
+		authorize.GET(common.K8SPath+"templateVersionDiff/:name", impl.DiffTemplateVersion)
+		authorize.PATCH(common.K8SPath+"templateVersion/:name/:version/default", impl.SetDefaultTemplateVersion)
 		authorize.GET(common.K8SPath+"namespaceLabel/:name", impl.GetNamespaceIsExistLabel)
 
 		// replica set
@@ -0,0 +1,121 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 标准的5段cron表达式：分 时 日 月 周，支持 * , - / ，周日可以为0或7
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// 日和周都有限制时，满足其中一个即可，和cron的行为一致
+	domStar, dowStar bool
+}
+
+var cronBounds = [5][2]uint{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func ParseCron(spec string) (*CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron %q: expected 5 fields", spec)
+	}
+	var bits [5]uint64
+	for i, field := range fields {
+		v, err := parseCronField(field, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron %q: %s", spec, err)
+		}
+		bits[i] = v
+	}
+	// 7和0都表示周日
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &CronSchedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, min, max uint) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := uint(1)
+		if i := strings.Index(part, "/"); i >= 0 {
+			v, err := strconv.ParseUint(part[i+1:], 10, 32)
+			if err != nil || v == 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			step, part = uint(v), part[:i]
+		}
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			v, err := strconv.ParseUint(bounds[0], 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			start, end = uint(v), uint(v)
+			if len(bounds) == 2 {
+				if v, err = strconv.ParseUint(bounds[1], 10, 32); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+				end = uint(v)
+			} else if step > 1 {
+				// 5/10表示从5开始每10个
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("value %q out of range %d-%d", part, min, max)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// 是否在t所在的分钟执行
+func (s *CronSchedule) Match(t time.Time) bool {
+	return s.dayMatch(t) && s.hour&(1<<uint(t.Hour())) != 0 && s.minute&(1<<uint(t.Minute())) != 0
+}
+
+// t之后的下一次执行时间，一年内没有时返回错误
+func (s *CronSchedule) Next(t time.Time) (time.Time, error) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(1, 0, 1)
+	for t.Before(end) {
+		switch {
+		case !s.dayMatch(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("no matching time within a year")
+}
+
+func (s *CronSchedule) dayMatch(t time.Time) bool {
+	if s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"*/15 0-6,22 1 1-12/2 1-5", false},
+		{"0 0 * * 7", false},
+		{"* * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"*/0 * * * *", true},
+		{"5-1 * * * *", true},
+		{"a * * * *", true},
+	}
+	for _, test := range tests {
+		_, err := ParseCron(test.spec)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseCron(%q) error = %v, wantErr %v", test.spec, err, test.wantErr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2026-10-17是周六
+	from := time.Date(2026, 10, 17, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 17, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 17, 10, 15, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2026, 10, 17, 10, 25, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)},
+		{"30 8 * * 1-5", time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC)},
+		// 周日可以写成0或7
+		{"0 0 * * 0", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		// 日和周都有限制时满足其中一个即可
+		{"0 0 1 * 1", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 18 * 3", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		// 其中一个为*时需要同时满足
+		{"0 0 * * 1", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		schedule, err := ParseCron(test.spec)
+		if err != nil {
+			t.Fatalf("ParseCron(%q) error: %v", test.spec, err)
+		}
+		got, err := schedule.Next(from)
+		if err != nil {
+			t.Errorf("Next(%q) error: %v", test.spec, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("Next(%q) = %v, want %v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestCronNextNotFound(t *testing.T) {
+	// 一年内没有2月29日
+	schedule, err := ParseCron("0 0 29 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := schedule.Next(time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Errorf("Next() = %v, want error", got)
+	}
+}
+
+func TestCronMatch(t *testing.T) {
+	schedule, err := ParseCron("0 12 15 * 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		time time.Time
+		want bool
+	}{
+		// 周四15日
+		{time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC), true},
+		// 周五16日
+		{time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC), true},
+		// 周六17日
+		{time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC), false},
+		{time.Date(2026, 10, 16, 12, 1, 0, 0, time.UTC), false},
+		{time.Date(2026, 10, 16, 13, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		if got := schedule.Match(test.time); got != test.want {
+			t.Errorf("Match(%v) = %v, want %v", test.time, got, test.want)
+		}
+	}
+}